@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var configCmd = &cli.Command{
+	Name:  "config",
+	Usage: "configuration tools",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "validate",
+			Usage:  "validate the configuration without starting the agent",
+			Action: validateConfig,
+		},
+		{
+			Name:  "show",
+			Usage: "print the configuration with secrets redacted, references like file:<path> are kept",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "effective",
+					Usage: "print the resolved configuration with env variables and --set applied, not only the files",
+				},
+			},
+			Action: showConfig,
+		},
+	},
+}
+
+func validateConfig(ctx *cli.Context) error {
+	if err := config.Init(ctx); err != nil {
+		fmt.Println(err)
+		return cli.Exit("configuration is invalid", 1)
+	}
+
+	fmt.Printf("configuration of env %s is valid\n", config.GetConfig().Env)
+	return nil
+}
+
+func showConfig(ctx *cli.Context) error {
+	var (
+		conf config.Config
+		err  error
+	)
+	if ctx.Bool("effective") {
+		conf, err = config.Parse(ctx)
+	} else {
+		conf, err = config.ParseFiles(ctx)
+	}
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// secrets are redacted by themselves
+	content, err := yaml.Marshal(map[string]config.Config{conf.Env: conf})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("# files: %v\n", conf.Files())
+	fmt.Print(string(content))
+	return nil
+}
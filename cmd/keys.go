@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	keyFlag = &cli.StringFlag{
+		Name:  "key",
+		Usage: "the identity key, Connector.IdentityKey or agent.key beside the configuration file by default",
+	}
+	keyTypeFlag = &cli.StringFlag{
+		Name:  "type",
+		Value: identity.Ed25519,
+		Usage: "the key algorithm, ed25519 or rsa",
+	}
+	keyBitsFlag = &cli.IntFlag{
+		Name:  "bits",
+		Value: identity.DefaultRSABits,
+		Usage: "the size of a rsa key",
+	}
+)
+
+var keysCmd = &cli.Command{
+	Name:  "keys",
+	Usage: "manage the identity key the agent authenticates to the platform with",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "generate",
+			Usage: "generate the identity key, an existing one is kept unless --force",
+			Flags: []cli.Flag{
+				keyFlag,
+				keyTypeFlag,
+				keyBitsFlag,
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "replace the existing key, the platform will not know the new one, use rotate instead if registered",
+				},
+			},
+			Action: generateKey,
+		},
+		{
+			Name:   "show",
+			Usage:  "print the algorithm, fingerprint and public key of the identity key",
+			Flags:  []cli.Flag{keyFlag},
+			Action: showKey,
+		},
+		{
+			Name:   "fingerprint",
+			Usage:  "print the fingerprint of the identity key, the key id the platform knows it by",
+			Flags:  []cli.Flag{keyFlag},
+			Action: fingerprintKey,
+		},
+		{
+			Name: "rotate",
+			Usage: "replace the identity key with a new one, the old one vouches for it on next handshake " +
+				"and is removed once the platform accepts it",
+			Flags:  []cli.Flag{keyFlag, keyTypeFlag, keyBitsFlag},
+			Action: rotateKey,
+		},
+		{
+			Name:  "export-public",
+			Usage: "print the public key in pem format to register it on the platform",
+			Flags: []cli.Flag{
+				keyFlag,
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "write to the file instead of stdout",
+				},
+			},
+			Action: exportPublicKey,
+		},
+	},
+}
+
+// keyPath return --key, or the identity key of the configuration
+func keyPath(ctx *cli.Context) (string, error) {
+	if p := ctx.String("key"); p != "" {
+		return util.ExpandHome(p), nil
+	}
+
+	conf, err := config.Parse(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return conf.IdentityKey(), nil
+}
+
+func loadKey(ctx *cli.Context) (*identity.Key, string, error) {
+	path, err := keyPath(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	k, err := identity.Load(path)
+	if errors.Is(err, identity.ErrNoKey) {
+		return nil, path, fmt.Errorf("%s, run `panda keys generate` first", err)
+	}
+
+	return k, path, err
+}
+
+func generateKey(ctx *cli.Context) error {
+	path, err := keyPath(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if _, err := os.Stat(path); err == nil && !ctx.Bool("force") {
+		return cli.Exit(fmt.Sprintf("%s exists, use --force to replace it or rotate to renew it", path), 1)
+	}
+
+	k, err := identity.Generate(ctx.String("type"), ctx.Int("bits"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if err := k.Save(path); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("generated %s key %s\n", k.Algorithm(), path)
+	fmt.Println(k.ID())
+	return nil
+}
+
+func showKey(ctx *cli.Context) error {
+	k, path, err := loadKey(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	pub, err := k.PublicPEM()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("path:        %s\n", path)
+	fmt.Printf("algorithm:   %s\n", k.Algorithm())
+	fmt.Printf("fingerprint: %s\n", k.ID())
+
+	previous, err := identity.Previous(path)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if previous != nil {
+		fmt.Printf("rotating:    from %s, not accepted by the platform yet\n", previous.ID())
+	}
+
+	fmt.Print(string(pub))
+	return nil
+}
+
+func fingerprintKey(ctx *cli.Context) error {
+	k, _, err := loadKey(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Println(k.ID())
+	return nil
+}
+
+func rotateKey(ctx *cli.Context) error {
+	// only the connector handshake vouches for the new key, the platform would reject the requests
+	// signed by it without one
+	conf, err := config.Parse(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if conf.Connector.URL == "" {
+		return cli.Exit("no Connector.URL configured, the platform can not accept a rotated key, "+
+			"register the new key on the platform and use generate --force instead", 1)
+	}
+
+	path, err := keyPath(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	k, err := identity.Rotate(path, ctx.String("type"), ctx.Int("bits"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("rotated to %s key %s, restart the agent to authenticate with it\n", k.Algorithm(), path)
+	fmt.Println(k.ID())
+	return nil
+}
+
+func exportPublicKey(ctx *cli.Context) error {
+	k, _, err := loadKey(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	pub, err := k.PublicPEM()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if out := ctx.String("out"); out != "" {
+		if err := os.WriteFile(out, pub, 0644); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	}
+
+	fmt.Print(string(pub))
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"runtime"
 
 	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
 	"github.com/urfave/cli/v2"
 )
 
@@ -34,6 +35,7 @@ func printVersion(ctx *cli.Context) {
 }
 
 func main() {
+	util.Version = version
 	go func() {
 		log.Println(http.ListenAndServe(":6060", nil))
 	}()
@@ -56,6 +58,15 @@ func main() {
 				Usage:       "configuration file directory",
 				Destination: &config.AppConfig.ConfigDir,
 			},
+			&cli.StringSliceFlag{
+				Name:    "config",
+				EnvVars: []string{"CONFIG_FILES"},
+				Usage:   "more configuration files merged after conf-dir in order, the later one wins",
+			},
+			&cli.StringSliceFlag{
+				Name:  "set",
+				Usage: "override a configuration field, like --set Platform.Timeout=30",
+			},
 			&cli.StringFlag{
 				Name:        "log-dir",
 				Value:       "",
@@ -70,6 +81,9 @@ func main() {
 				Usage:  "run service",
 				Action: run,
 			},
+			configCmd,
+			secretsCmd,
+			keysCmd,
 		},
 	}
 
@@ -4,15 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
 	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/bitrainforest/PandaAgent/inside/config"
 	"github.com/bitrainforest/PandaAgent/inside/engine"
+	"github.com/bitrainforest/PandaAgent/inside/identity"
 	logwriter "github.com/bitrainforest/PandaAgent/inside/log"
+	"github.com/bitrainforest/PandaAgent/inside/minerclient"
+	"github.com/bitrainforest/PandaAgent/inside/service"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
@@ -41,15 +46,6 @@ func initConfig(ctx *cli.Context) {
 func run(ctx *cli.Context) error {
 	initConfig(ctx)
 
-	logLevelString := os.Getenv("LOG_LEVEL")
-	if logLevelString == "" {
-		logLevelString = config.AppConfig.Log.Level
-	}
-
-	if logLevelString == "" {
-		logLevelString = "debug"
-	}
-
 	f, err := os.OpenFile(config.GetConfig().Log.Dir, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		fmt.Println(err)
@@ -58,33 +54,161 @@ func run(ctx *cli.Context) error {
 		log.Logger = log.Output(f)
 	}
 
-	lvl, err := zerolog.ParseLevel(logLevelString)
-	if err == nil {
-		zerolog.SetGlobalLevel(lvl)
-	} else {
-		log.Warn().Str("value", logLevelString).Err(err).Msg("Invalid level value, using info by default")
+	setLogLevel(config.GetConfig().Log.Level)
+
+	agentID, err := identity.LoadOrCreateID(config.GetConfig().AgentIDFile())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load the agent id")
+	}
+	config.SetAgentID(agentID)
+	log.Info().Msgf("agent id: %s", agentID)
+
+	// the platform requests and the connector are signed with it, only the agent creates it on first run
+	if _, err := identity.LoadOrCreate(config.GetConfig().IdentityKey()); err != nil {
+		log.Fatal().Err(err).Msg("failed to load the identity key")
 	}
 
 	log.Info().Interface("conf", config.GetConfig()).Msg("Print the Config")
+	minerCli, err := minerclient.NewMinerCli(config.GetConfig())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to resolve the miner api")
+	}
+
+	// the signals are handled below once the agent runs, stop waiting for the miner on them
+	waitCtx, stopWait := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err = minerCli.WaitVerify(waitCtx)
+	stopWait()
+	if errors.Is(err, context.Canceled) {
+		log.Info().Msg("stopped while waiting for the miner")
+		return nil
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to verify the miner")
+	}
+
+	if d := config.GetConfig().Miner.Discover; d.Enable {
+		sp, err := minerCli.DiscoverStorage(d.Label, d.Weight)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to discover the storage path")
+		}
+
+		config.SetStorage(sp.ID, sp.SealedPath(), sp.CachePath())
+		log.Info().Str("id", sp.ID).Str("path", sp.Path).Uint64("weight", sp.Meta.Weight).Int64("available", sp.Stat.Available).Msg("discover the storage path")
+	}
+
 	log.Info().Msg("starting the agent...")
-	eg := engine.InitEngine(config.GetConfig(), context.Background())
+	eg, err := engine.InitEngine(config.GetConfig(), context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to init the agent")
+	}
+
+	var reloadLock sync.Mutex
+	reload := func() error {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+
+		conf, rejected, err := config.Reload()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rejected {
+			log.Warn().Msgf("[Reload] %s", r)
+		}
+
+		setLogLevel(conf.Log.Level)
+		eg.Reload(conf)
+		return nil
+	}
+	eg.SetReload(reload)
 
 	if err := eg.Run(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to run engine")
 	}
 
-	defer eg.Stop()
+	var admin *service.Admin
+	if conf := config.GetConfig(); conf.Admin.Address != "" {
+		admin = service.InitAdmin(conf.Admin.Address, conf.Admin.Token.Value(), reload)
+		admin.Handle("/admin/mirrors", http.MethodGet, func(r *http.Request) (interface{}, error) {
+			return eg.Transformer.Mirrors(), nil
+		})
+		admin.Handle("/admin/queue", http.MethodGet, func(r *http.Request) (interface{}, error) {
+			return eg.Transformer.Queue(), nil
+		})
+		// like /admin/queue/bump?sector=10&priority=100
+		admin.Handle("/admin/queue/bump", http.MethodPost, func(r *http.Request) (interface{}, error) {
+			sectorID, err := strconv.Atoi(r.FormValue("sector"))
+			if err != nil {
+				return nil, fmt.Errorf("bad sector %q", r.FormValue("sector"))
+			}
+			priority, err := strconv.Atoi(r.FormValue("priority"))
+			if err != nil {
+				return nil, fmt.Errorf("bad priority %q", r.FormValue("priority"))
+			}
+
+			return nil, eg.Transformer.Bump(sectorID, priority)
+		})
+		admin.Run()
+	}
 
-	ch := make(chan os.Signal, 1)
+	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
 
-	for {
-		select {
-		case sig := <-ch:
-			fmt.Printf("Got signal: %s, Exit..\n", sig)
-			return errors.New(sig.String())
+	var sig os.Signal
+	for sig = range ch {
+		if sig != syscall.SIGHUP {
+			break
 		}
+
+		log.Info().Msgf("Got signal: %s, reload the configuration", sig)
+		if err := reload(); err != nil {
+			log.Error().Err(err).Msg("failed to reload the configuration, keep running with the old one")
+		}
+	}
+	fmt.Printf("Got signal: %s, draining, send again to exit immediately..\n", sig)
+
+	grace := config.GetConfig().Transformer.ShutdownTimeout
+	if grace <= 0 {
+		grace = engine.DefaultShutdownTimeout
+	}
+	stopCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		if admin != nil {
+			admin.Stop(stopCtx)
+		}
+		eg.Stop(stopCtx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		fmt.Printf("Exit..\n")
+	case sig := <-ch:
+		fmt.Printf("Got signal: %s again, Exit..\n", sig)
+		os.Exit(1)
+	}
+
+	return errors.New(sig.String())
+}
+
+// setLogLevel set the global log level, LOG_LEVEL env takes precedence over the configured level
+func setLogLevel(level string) {
+	logLevelString := os.Getenv("LOG_LEVEL")
+	if logLevelString == "" {
+		logLevelString = level
 	}
 
-	return nil
+	if logLevelString == "" {
+		logLevelString = "debug"
+	}
+
+	lvl, err := zerolog.ParseLevel(logLevelString)
+	if err == nil {
+		zerolog.SetGlobalLevel(lvl)
+	} else {
+		log.Warn().Str("value", logLevelString).Err(err).Msg("Invalid level value, using info by default")
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/urfave/cli/v2"
+)
+
+var secretsCmd = &cli.Command{
+	Name:  "secrets",
+	Usage: "secret tools",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "encrypt",
+			Usage:     "encrypt a secret for the configuration, the value is read from stdin if not given",
+			ArgsUsage: "[value]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "public-key",
+					Usage: "the rsa public key, public.pem beside the configuration file by default",
+				},
+			},
+			Action: encryptSecret,
+		},
+		{
+			Name:  "keygen",
+			Usage: "generate the rsa keypair to encrypt the secrets, private.pem and public.pem beside the configuration file",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "bits",
+					Value: identity.DefaultRSABits,
+					Usage: "the size of the rsa key",
+				},
+			},
+			Action: secretKeygen,
+		},
+	},
+}
+
+func encryptSecret(ctx *cli.Context) error {
+	value := ctx.Args().First()
+	if value == "" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		value = strings.TrimSpace(string(b))
+	}
+	if value == "" {
+		return cli.Exit("nothing to encrypt", 1)
+	}
+
+	publicKey := ctx.String("public-key")
+	if publicKey == "" {
+		publicKey = filepath.Join(config.AppConfig.Dir(), config.DefaultPublicKey)
+	}
+
+	enc, err := config.EncryptSecret(value, publicKey)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("encrypt with %s err: %s", publicKey, err), 1)
+	}
+
+	fmt.Println(enc)
+	return nil
+}
+
+func secretKeygen(ctx *cli.Context) error {
+	dir := config.AppConfig.Dir()
+	if err := util.RSAGenKey(ctx.Int("bits"), dir); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("generated %s and %s in %s\n", config.DefaultPrivateKey, config.DefaultPublicKey, dir)
+	return nil
+}
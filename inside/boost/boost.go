@@ -2,12 +2,14 @@ package boost
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 
+	"github.com/bitrainforest/PandaAgent/inside/jsonrpc"
 	acrypto "github.com/filecoin-project/go-state-types/crypto"
 	"github.com/rs/zerolog/log"
 )
@@ -32,39 +34,20 @@ type Deal struct {
 
 type BoostCli struct {
 	cli        *http.Client
-	url        string
+	rpc        *jsonrpc.Client
 	graphQlURL string
-	apiToken   string
 	ch         chan []byte
 }
 
-func InitBoostCli(url, graphQlURL, token string, ch chan []byte) *BoostCli {
+func InitBoostCli(url, graphQlURL, token string, cli *http.Client, ch chan []byte) *BoostCli {
 	return &BoostCli{
-		cli: &http.Client{
-			Transport: &http.Transport{
-				TLSHandshakeTimeout:   5 * time.Second,
-				ResponseHeaderTimeout: 10 * time.Second,
-				MaxIdleConns:          50,
-				MaxIdleConnsPerHost:   1,
-				MaxConnsPerHost:       10,
-				IdleConnTimeout:       10 * time.Second,
-			},
-			Timeout: 10 * time.Second,
-		},
-		url:        url,
+		cli:        cli,
+		rpc:        jsonrpc.NewClient(cli, url, jsonrpc.StaticToken(token)),
 		graphQlURL: graphQlURL,
-		apiToken:   token,
 		ch:         ch,
 	}
 }
 
-// todo: use json-rpc tu marshal
-type BoostDealReq struct {
-	Method string        `json:"method"`
-	Params []interface{} `json:"params"`
-	ID     int           `json:"id"`
-}
-
 type BoostDealResp struct {
 	Result struct {
 		DealUuid           string    `json:"DealUuid,omitempty"`
@@ -91,41 +74,15 @@ type BoostDealResp struct {
 	} `json:"result,omitempty"`
 }
 
-// send json-rpc Filecoin.BoostDeal to boostd server
+// send json-rpc Filecoin.BoostDeal to boostd server, return the whole json-rpc response as received
 // todo:
 func (bc *BoostCli) GetBoostDeal(id string) ([]byte, error) {
-	bdq := BoostDealReq{
-		Method: MethodFilecoinBoostDeal,
-		ID:     0,
-	}
-
-	bdq.Params = append(bdq.Params, id)
-	res, err := json.Marshal(bdq)
-	if err != nil {
-		return nil, err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, bc.url, bytes.NewBuffer(res))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", bc.apiToken)
-	resp, err := bc.cli.Do(req)
+	resp, err := bc.rpc.Invoke(MethodFilecoinBoostDeal, id)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("%s err status: %d", MethodFilecoinBoostDeal, resp.StatusCode)
-	}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	b := []byte(resp.Raw)
 
 	/*
 		dealRes := BoostDealResp{}
@@ -206,8 +163,8 @@ func (bc *BoostCli) GraphQl(offset, limit int) ([]DealID, error) {
 	return res, nil
 }
 
-// query loop
-func (bc *BoostCli) Start() {
+// query loop, exit when ctx is done
+func (bc *BoostCli) Start(ctx context.Context) {
 	defer log.Warn().Msgf("[BoostCli] exit")
 
 	off := 0
@@ -216,7 +173,9 @@ func (bc *BoostCli) Start() {
 		res, err := bc.GraphQl(off, limit)
 		if err != nil {
 			log.Error().Msgf("[BoostCli] GraphQl off: %d, limit: %d, err: %s", off, limit, err)
-			time.Sleep(3 * time.Second)
+			if !sleep(ctx, 3*time.Second) {
+				return
+			}
 			continue
 		}
 
@@ -224,15 +183,33 @@ func (bc *BoostCli) Start() {
 		for i := 0; i < len(res); i++ {
 			deal, err := bc.GetBoostDeal(res[i].ID)
 			if err != nil {
-				log.Error().Msgf("[BoostCli] GetBoostDeal %d, err: %s", res[i].ID, err)
+				log.Error().Msgf("[BoostCli] GetBoostDeal %s, err: %s", res[i].ID, err)
 				continue
 			}
 
 			//log.Debug().Msgf("[BoostCli] GetBoostDeal deal: %+v", deal)
-			bc.ch <- deal
+			select {
+			case bc.ch <- deal:
+			case <-ctx.Done():
+				return
+			}
 		}
 
 		// maybe need configurable
-		time.Sleep(5 * time.Second)
+		if !sleep(ctx, 5*time.Second) {
+			return
+		}
+	}
+}
+
+// sleep return false if ctx is done before d elapsed
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
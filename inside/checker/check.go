@@ -3,7 +3,6 @@ package checker
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -15,7 +14,9 @@ import (
 
 	"github.com/bitrainforest/PandaAgent/inside/config"
 	"github.com/bitrainforest/PandaAgent/inside/downloader"
+	"github.com/bitrainforest/PandaAgent/inside/httpclient"
 	"github.com/bitrainforest/PandaAgent/inside/types"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
 	"github.com/rs/zerolog/log"
 )
 
@@ -35,27 +36,28 @@ type Checker struct {
 	doneCtx        context.Context
 	cancle         context.CancelFunc
 	token          string
-	// the total sectors this agent need download
-	sectorsTotal int64
+	agentID        string
+	registerURL    string
+	// conf is kept to report the storage and capabilities on register
+	conf config.Config
+	// host is the identity reported by the heartbeat
+	host util.Host
+	// pushed return true if the sectors are pushed by the connector, the polling is paused then
+	pushed func() bool
+	// tickers are reset when the frequencies are reloaded
+	checkTicker *time.Ticker
+	heartTicker *time.Ticker
 }
 
-func InitChecker(conf config.Config, parentCtx context.Context) Checker {
-	var c Checker
-	c.cli = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			TLSHandshakeTimeout:   5 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			MaxIdleConns:          50,
-			MaxIdleConnsPerHost:   1,
-			MaxConnsPerHost:       10,
-			IdleConnTimeout:       10 * time.Second,
-		},
-		Timeout: time.Duration(conf.GH.Timeout) * time.Second,
+func InitChecker(conf config.Config, parentCtx context.Context) (*Checker, error) {
+	cli, err := httpclient.New(conf, config.EndpointPlatform)
+	if err != nil {
+		return nil, fmt.Errorf("build platform client err: %s", err)
 	}
 
+	c := &Checker{}
+	c.cli = cli
+
 	ctx, cancle := context.WithCancel(parentCtx)
 	c.checkURL = conf.GH.QueryURL
 	c.pingURL = conf.GH.PingURL
@@ -64,19 +66,49 @@ func InitChecker(conf config.Config, parentCtx context.Context) Checker {
 	c.minerID = conf.Miner.ID
 	c.doneCtx = ctx
 	c.cancle = cancle
-	c.token = conf.GH.Token
+	c.token = conf.GH.Token.Value()
+	c.host = util.HostInfo()
+	c.agentID = conf.AgentID
+	c.registerURL = conf.GH.RegisterURL
+	c.conf = conf
+
+	return c, nil
+}
 
-	return c
+// Reload apply the frequencies, urls and token
+func (c *Checker) Reload(conf config.Config) {
+	c.Lock()
+	defer c.Unlock()
+	c.checkURL = conf.GH.QueryURL
+	c.pingURL = conf.GH.PingURL
+	c.registerURL = conf.GH.RegisterURL
+	c.conf = conf
+	c.token = conf.GH.Token.Value()
+	if c.checkFrequency != conf.GH.CheckFrequency && c.checkTicker != nil {
+		c.checkTicker.Reset(conf.GH.CheckFrequency)
+	}
+	if c.heartFrequency != conf.GH.HeartFrequency && c.heartTicker != nil {
+		c.heartTicker.Reset(conf.GH.HeartFrequency)
+	}
+	c.checkFrequency = conf.GH.CheckFrequency
+	c.heartFrequency = conf.GH.HeartFrequency
+	log.Info().Msgf("[Checker] reload, check frequency: %s, heart frequency: %s", c.checkFrequency, c.heartFrequency)
 }
 
-func (c Checker) Ping() {
+func (c *Checker) Ping() {
+	c.Lock()
+	ticker := time.NewTicker(c.heartFrequency)
+	c.heartTicker = ticker
+	c.Unlock()
+
 	go func() {
-		ticker := time.Tick(c.heartFrequency)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-c.doneCtx.Done():
 				log.Info().Msgf("[Checker] Heart Stop.")
-			case <-ticker:
+				return
+			case <-ticker.C:
 				log.Info().Msgf("[Checker] do Heart.")
 				err := c.ping()
 				if err != nil {
@@ -89,21 +121,32 @@ func (c Checker) Ping() {
 }
 
 type AgentStatus struct {
-	Status       int   `json:"status,omitempty"`
-	NeedDownload int64 `json:"need_download,omitempty"`
+	Status int `json:"status,omitempty"`
+	// NeedDownload is the sectors queued and in progress
+	NeedDownload int64            `json:"need_download,omitempty"`
+	Progress     downloader.Stats `json:"progress"`
+	Version      string           `json:"version,omitempty"`
+	Host         util.Host        `json:"host"`
+	AgentID      string           `json:"agentId,omitempty"`
 }
 
 // just ping, we do not hold the connection.
-func (c Checker) ping() error {
+func (c *Checker) ping() error {
+	stats := downloader.GetGlobalTransformer().Stats()
 	status := AgentStatusNormal
-	if downloader.Downloading() {
+	if stats.Queued+stats.InProgress > 0 {
 		status = AgentStatusDownloading
 	}
 	as := AgentStatus{
-		Status: status,
+		Status:       status,
+		NeedDownload: int64(stats.Queued + stats.InProgress),
+		Progress:     stats,
+		Version:      util.Version,
+		Host:         c.host,
+		AgentID:      c.agentID,
 	}
 	c.Lock()
-	as.NeedDownload = c.sectorsTotal
+	pingURL, token := c.pingURL, c.token
 	c.Unlock()
 
 	content, err := json.Marshal(as)
@@ -113,13 +156,13 @@ func (c Checker) ping() error {
 
 	log.Debug().Msgf("[Checker] ping content: %+v", as)
 
-	req, err := http.NewRequest("POST", c.pingURL, bytes.NewReader(content))
+	req, err := http.NewRequest("POST", pingURL, bytes.NewReader(content))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("minerToken", c.token)
+	req.Header.Set("minerToken", token)
 	resp, err := c.cli.Do(req)
 	if err != nil {
 		return err
@@ -133,39 +176,53 @@ func (c Checker) ping() error {
 	return nil
 }
 
+// SetPushed pause the polling while pushed return true
+func (c *Checker) SetPushed(pushed func() bool) {
+	c.Lock()
+	c.pushed = pushed
+	c.Unlock()
+}
+
 // checker will get downloadable sectors and send it to channel ch
-func (c Checker) Check(ch chan types.Sector) {
+func (c *Checker) Check(ch chan types.Sector) {
+	c.Lock()
+	ticker := time.NewTicker(c.checkFrequency)
+	c.checkTicker = ticker
+	c.Unlock()
+
 	go func() {
-		ticker := time.Tick(c.checkFrequency)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-c.doneCtx.Done():
 				log.Info().Msgf("[Checker] Check Stop.")
 				return
-			case <-ticker:
-				log.Info().Msgf("[Checker] do Check.")
-				res, err := c.check()
-				if err != nil {
-					log.Error().Msgf("[Checker] Check err: %s", err)
+			case <-ticker.C:
+				c.Lock()
+				pushed := c.pushed
+				c.Unlock()
+				if pushed != nil && pushed() {
+					log.Debug().Msgf("[Checker] connector is up, skip Check.")
 					continue
 				}
 
-				if res == nil {
+				log.Info().Msgf("[Checker] do Check.")
+				res, complete, err := c.check()
+				if err != nil {
+					log.Error().Msgf("[Checker] Check err: %s", err)
 					continue
 				}
 
-				c.Lock()
-				c.sectorsTotal += int64(len(res))
-				c.Unlock()
-
+				// the sectors missing in a whole list for several polls are withdrawn
+				res = downloader.GetGlobalTransformer().Sync(res, complete)
 				if len(res) > 0 {
 					for _, v := range res {
-						// avoid waste transform
-						if downloader.GetGlobalTransformer().Skip(v) {
-							continue
+						log.Info().Msgf("[Checker] Check get miner: %s sector: %d to download", c.minerID, v.ID)
+						select {
+						case ch <- v:
+						case <-c.doneCtx.Done():
+							return
 						}
-						log.Info().Msgf("[Checker] Check get miner: %s sector: %d to download", c.minerID, v)
-						ch <- v
 					}
 				}
 			}
@@ -182,72 +239,100 @@ type checkResponse struct {
 
 type Data struct {
 	List []DataItem `json:"list,omitempty"`
+	// Total is the length of the whole list, the list is a page of it if less
+	Total int `json:"total,omitempty"`
 }
 
 type DataItem struct {
 	MinerID    string `json:"minerId,omitempty"`
 	SectorId   string `json:"sectorId,omitempty"`
 	SectorType string `json:"sectorType,omitempty"`
+	// Source names where the sealing cluster parks the sector
+	Source string `json:"source,omitempty"`
+	// Urgent sectors are near the proving deadline or have expiring deals, they are downloaded first
+	Urgent   bool `json:"urgent,omitempty"`
+	Priority int  `json:"priority,omitempty"`
 }
 
-func (c Checker) check() ([]types.Sector, error) {
-	req, err := http.NewRequest("GET", c.checkURL, nil)
+// check return the sectors listed, and whether the list is the whole one
+func (c *Checker) check() ([]types.Sector, bool, error) {
+	c.Lock()
+	checkURL, token := c.checkURL, c.token
+	c.Unlock()
+
+	req, err := http.NewRequest("GET", checkURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	req.Header.Set("minerToken", c.token)
+	req.Header.Set("minerToken", token)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := c.cli.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("Checker check err status: %d", resp.StatusCode)
+		return nil, false, fmt.Errorf("Checker check err status: %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	var result checkResponse
 	if http.StatusNoContent != resp.StatusCode {
 		if jsonErr := json.Unmarshal(body, &result); jsonErr != nil {
-			return nil, fmt.Errorf("%s: %s", "bad_response", jsonErr.Error())
+			return nil, false, fmt.Errorf("%s: %s", "bad_response", jsonErr.Error())
 		}
 	}
 
 	if strings.ToLower(result.Msg) != "success" {
-		return nil, fmt.Errorf("Checker response msg: %s", result.Msg)
+		return nil, false, fmt.Errorf("Checker response msg: %s", result.Msg)
 	}
 
-	if len(result.Data.List) > 0 {
-		sectors := make([]types.Sector, 0, 5)
-		for _, item := range result.Data.List {
-			if item.MinerID != c.minerID {
-				continue
-			}
+	sectors := c.Sectors(result.Data.List)
+	if len(sectors) == 0 {
+		log.Debug().Msgf("[Checker] there is no sectors need download")
+	}
 
-			sectorID, _ := strconv.Atoi(item.SectorId)
-			sectors = append(sectors, types.Sector{
-				ID:     sectorID,
-				Try:    0,
-				Status: types.NeedFour,
-			})
+	complete := result.Data.Total <= len(result.Data.List)
+	if !complete {
+		log.Warn().Msgf("[Checker] the list has %d of %d sectors, nothing is withdrawn", len(result.Data.List), result.Data.Total)
+	}
+
+	return sectors, complete, nil
+}
+
+// Sectors convert the items of this miner to the sectors to download
+func (c *Checker) Sectors(items []DataItem) []types.Sector {
+	sectors := make([]types.Sector, 0, len(items))
+	for _, item := range items {
+		if item.MinerID != c.minerID {
+			continue
 		}
 
-		return sectors, nil
+		sectorID, _ := strconv.Atoi(item.SectorId)
+		priority := item.Priority
+		if item.Urgent && priority < downloader.PriorityUrgent {
+			priority = downloader.PriorityUrgent
+		}
+		sectors = append(sectors, types.Sector{
+			ID:       sectorID,
+			Try:      0,
+			Status:   types.NeedFour,
+			Source:   item.Source,
+			Miner:    item.MinerID,
+			Priority: priority,
+		})
 	}
 
-	log.Debug().Msgf("[Checker] there is no sectors need download")
-
-	return nil, nil
+	return sectors
 }
 
-func (c Checker) Stop() {
+func (c *Checker) Stop() {
 	log.Info().Msgf("[Checker] Stop.")
 	c.cancle()
 }
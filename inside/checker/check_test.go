@@ -0,0 +1,91 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/types"
+)
+
+// the tickers are started and reset at the same time, go test -race checks them
+func TestReloadFrequency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Checker{
+		checkFrequency: time.Hour,
+		heartFrequency: time.Hour,
+		doneCtx:        ctx,
+		cancle:         cancel,
+	}
+
+	// the polling is paused, every tick calls pushed only
+	ticked := make(chan struct{}, 1)
+	c.SetPushed(func() bool {
+		select {
+		case ticked <- struct{}{}:
+		default:
+		}
+		return true
+	})
+
+	var conf config.Config
+	conf.GH.CheckFrequency = 10 * time.Millisecond
+	conf.GH.HeartFrequency = time.Hour
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Reload(conf)
+		}
+	}()
+	c.Ping()
+	c.Check(make(chan types.Sector))
+	wg.Wait()
+
+	// the running ticker follows the reloaded frequency
+	conf.GH.CheckFrequency = time.Hour
+	c.Reload(conf)
+	for len(ticked) > 0 {
+		<-ticked
+	}
+	conf.GH.CheckFrequency = 10 * time.Millisecond
+	c.Reload(conf)
+	select {
+	case <-ticked:
+	case <-time.After(time.Second):
+		t.Fatal("the reloaded check frequency is not applied")
+	}
+}
+
+// the list is complete only if it has all of Total, a page of it never withdraws
+func TestCheckComplete(t *testing.T) {
+	for _, c := range []struct {
+		total    int
+		complete bool
+	}{
+		{0, true},
+		{2, true},
+		{3, false},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"msg":"success","data":{"list":[{"minerId":"t01000","sectorId":"1"},{"minerId":"t01000","sectorId":"2"}],"total":%d}}`, c.total)
+		}))
+		ch := &Checker{cli: srv.Client(), checkURL: srv.URL, minerID: "t01000"}
+		sectors, complete, err := ch.check()
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sectors) != 2 || complete != c.complete {
+			t.Fatalf("total %d: %d sectors, complete %v, want %v", c.total, len(sectors), complete, c.complete)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package checker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+// registerRetryMax caps the wait between the registrations at 2^registerRetryMax seconds
+const registerRetryMax = 8
+
+// Registration tells the platform who the agent is, several agents of a miner are told apart by AgentID
+type Registration struct {
+	AgentID      string    `json:"agentId"`
+	Hostname     string    `json:"hostname"`
+	IPs          []string  `json:"ips,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	Miners       []string  `json:"miners"`
+	Storage      []Storage `json:"storage,omitempty"`
+	Capabilities []string  `json:"capabilities"`
+}
+
+// Storage is a path the agent stores sectors in
+type Storage struct {
+	ID     string `json:"id,omitempty"`
+	Sealed string `json:"sealed,omitempty"`
+	Cache  string `json:"cache,omitempty"`
+}
+
+// Register report the agent to Platform.RegisterURL, it retries until accepted or stopped.
+// Nothing is done if RegisterURL is not set.
+func (c *Checker) Register() {
+	c.Lock()
+	registerURL := c.registerURL
+	c.Unlock()
+	if registerURL == "" {
+		return
+	}
+
+	go func() {
+		var retry int64
+		for {
+			err := c.register()
+			if err == nil {
+				log.Info().Msgf("[Checker] registered agent %s", c.agentID)
+				return
+			}
+			log.Error().Msgf("[Checker] register err: %s", err)
+
+			wait := util.Pow2(retry)
+			if retry < registerRetryMax {
+				retry++
+			}
+			select {
+			case <-c.doneCtx.Done():
+				return
+			case <-time.After(time.Duration(wait) * time.Second):
+			}
+		}
+	}()
+}
+
+func (c *Checker) register() error {
+	c.Lock()
+	registerURL, token, conf := c.registerURL, c.token, c.conf
+	c.Unlock()
+
+	r := registration(conf, c.host)
+	content, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("[Checker] register content: %+v", r)
+
+	req, err := http.NewRequest("POST", registerURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("minerToken", token)
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Checker register err status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func registration(conf config.Config, host util.Host) Registration {
+	r := Registration{
+		AgentID:  conf.AgentID,
+		Hostname: host.Hostname,
+		IPs:      host.IPs,
+		Version:  util.Version,
+		Miners:   []string{conf.Miner.ID},
+		Storage: []Storage{{
+			ID:     conf.Miner.StorageID,
+			Sealed: conf.Miner.SealedPath,
+			Cache:  conf.Miner.SealedCachePath,
+		}},
+	}
+
+	r.Capabilities = append(r.Capabilities, "download", "declare")
+	types := map[string]bool{}
+	for _, s := range conf.Transformer.Sources {
+		types[s.Type] = true
+	}
+	sources := make([]string, 0, len(types))
+	for t := range types {
+		sources = append(sources, "source:"+t)
+	}
+	sort.Strings(sources)
+	r.Capabilities = append(r.Capabilities, sources...)
+
+	if conf.Connector.URL != "" {
+		r.Capabilities = append(r.Capabilities, "connector", "fetch", "copy")
+		if len(conf.Connector.Shell) > 0 {
+			r.Capabilities = append(r.Capabilities, "shell")
+		}
+		if len(conf.Connector.Python) > 0 {
+			r.Capabilities = append(r.Capabilities, "python")
+		}
+	}
+
+	return r
+}
@@ -1,89 +1,192 @@
-// Note: this package is not used now, just for websocket in future!
 package client
 
 import (
-	"net/http"
+	"errors"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/gorilla/websocket"
 	// todo: fix the import path named internal replace inside
+	"github.com/bitrainforest/PandaAgent/inside/config"
 	"github.com/bitrainforest/PandaAgent/inside/connector"
+	"github.com/bitrainforest/PandaAgent/inside/httpclient"
+	"github.com/bitrainforest/PandaAgent/inside/identity"
 	"github.com/bitrainforest/PandaAgent/pkg/util"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	c          *client
 	numWorkers = 8
 )
 
-type client struct {
-	ws *connector.HConn
+// badType marks a sequenced message can not be deserialized, it is skipped in order
+const badType connector.MessageType = "bad"
+
+// Handler process a message pushed by the platform
+type Handler func(msg *connector.Message)
+
+// Client keeps the websocket to the platform, the pushed messages are processed by the handler.
+// The messages are numbered and acknowledged both ways, a reconnect resumes the session by replaying
+// the ones not acknowledged, so a message is processed once as long as the agent is running. The
+// session is not persisted, a restarted agent starts a new one and the platform decides what to send
+// again. The sequenced messages are handled one by one in order, the others by the workers.
+type Client struct {
+	ws   *connector.HConn
+	sess *session
 
 	readCh  chan *connector.Message
 	writeCh chan *connector.Message
+	// ackCh asks the write pump to acknowledge, resendCh to replay after reconnect
+	ackCh    chan struct{}
+	resendCh chan struct{}
 
-	//workers  []*downloader
 	workerCh chan *connector.Message
+	// seqCh is handled by one worker, so a cancel never runs before the fetch it follows
+	seqCh   chan *connector.Message
+	handler Handler
 
 	doneCh chan struct{}
 
 	retryMax int64
 }
 
-func Init() {
-	header := http.Header{}
-	c = &client{
-		ws:      connector.NewConn("localhost:1234/websocket", header),
-		readCh:  make(chan *connector.Message, 16),
-		writeCh: make(chan *connector.Message, 16),
-		// todo: downloader implement
-		//workers:  make([]*downloader, 0),
-		workerCh: make(chan *connector.Message, 16),
-		doneCh:   make(chan struct{}),
-		retryMax: 5,
+func Init(conf config.Config, handler Handler) (*Client, error) {
+	dialer, err := httpclient.Dialer(conf)
+	if err != nil {
+		return nil, err
 	}
 
+	auth, err := handshake(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	header := httpclient.Headers(conf)
+	header.Set("minerToken", conf.GH.Token.Value())
+	c := newClient(connector.NewConn(conf.Connector.URL, header, dialer, auth), handler)
+	c.ws.SetHandshake(c.sess.handshake)
+	c.ws.SetOnOpen(c.reopened)
+
 	for i := 0; i < numWorkers; i++ {
-		//todo: start downloader here
+		go c.worker(c.workerCh)
 	}
+	go c.worker(c.seqCh)
 
 	go c.writePump()
 	go c.readPump()
 	go c.dispatch()
+	log.Info().Msgf("[Client] connect to %s", conf.Connector.URL)
+	return c, nil
+}
+
+func newClient(ws *connector.HConn, handler Handler) *Client {
+	return &Client{
+		ws:       ws,
+		readCh:   make(chan *connector.Message, 16),
+		writeCh:  make(chan *connector.Message, 16),
+		ackCh:    make(chan struct{}, 1),
+		resendCh: make(chan struct{}, 1),
+		workerCh: make(chan *connector.Message, 16),
+		seqCh:    make(chan *connector.Message, 16),
+		sess:     newSession(),
+		handler:  handler,
+		doneCh:   make(chan struct{}),
+		retryMax: 5,
+	}
+}
+
+// handshake load the identity key, the pending rotation and the platform keys
+func handshake(conf config.Config) (*connector.Handshake, error) {
+	path := conf.IdentityKey()
+	key, err := identity.Load(path)
+	if errors.Is(err, identity.ErrNoKey) {
+		return nil, fmt.Errorf("%s, run `panda keys generate` first", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := identity.Previous(path)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &connector.Handshake{
+		Key:      key,
+		Previous: previous,
+		Rotated: func() {
+			// the platform knows the new key now
+			if err := os.Remove(identity.PreviousPath(path)); err != nil {
+				log.Error().Msgf("[Client] remove the previous key err: %s", err)
+			}
+		},
+		Host:    util.HostInfo().Hostname,
+		AgentID: conf.AgentID,
+	}
+	for _, p := range conf.Connector.ServerKeys {
+		k, err := identity.LoadPublic(util.ExpandHome(p))
+		if err != nil {
+			return nil, fmt.Errorf("server key %s: %s", p, err)
+		}
+		auth.ServerKeys = append(auth.ServerKeys, k)
+	}
+	if len(auth.ServerKeys) == 0 {
+		return nil, fmt.Errorf("no server key to verify the platform")
+	}
+
+	log.Info().Msgf("[Client] identity key: %s (%s)", key.ID(), key.Algorithm())
+	return auth, nil
+}
+
+// Healthy return true if the websocket is open
+func (c *Client) Healthy() bool {
+	return c.ws.CheckHealth()
 }
 
-func (c *client) waitAndRetry(counter *int64) {
+// waitAndRetry return false if the client is stopped while waiting
+func (c *Client) waitAndRetry(counter *int64) bool {
 	wait := util.Pow2(*counter)
-	time.Sleep(time.Duration(wait) * time.Second)
 	if *counter < c.retryMax {
 		(*counter)++
 	}
+
+	select {
+	case <-time.After(time.Duration(wait) * time.Second):
+		return true
+	case <-c.doneCh:
+		return false
+	}
 }
 
-func (c *client) resetCounter(counter *int64) {
+func (c *Client) resetCounter(counter *int64) {
 	*counter = 0
 }
 
-func (c *client) writePump() {
+func (c *Client) writePump() {
 	defer log.Info().Msg("write pump stop")
-	var writeRetryCnt int64 = 0
 	for {
 		select {
 		case msg := <-c.writeCh:
-			s, err := msg.Serialize()
-			if err != nil {
+			if _, err := msg.Serialize(); err != nil {
 				log.Error().Err(err).Msg("message serialization failed")
+				// free the window taken by Response
+				<-c.sess.window
 				continue
 			}
-		WRITE:
-			c.ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			if err = c.ws.WriteMessage(websocket.BinaryMessage, s); err != nil {
-				log.Error().Err(err).Msg("websocket write failed")
-				c.waitAndRetry(&writeRetryCnt)
-				goto WRITE
-			} else {
-				c.resetCounter(&writeRetryCnt)
+			c.sess.track(msg)
+			c.write(msg)
+		case <-c.ackCh:
+			c.write(connector.NewAck(c.sess.lastProcessed()))
+		case <-c.resendCh:
+			msgs := c.sess.resend()
+			if len(msgs) > 0 {
+				log.Info().Msgf("[Client] replay %d messages not acknowledged", len(msgs))
+			}
+			for _, msg := range msgs {
+				if !c.write(msg) {
+					break
+				}
 			}
 		case <-c.doneCh:
 			return
@@ -91,15 +194,50 @@ func (c *client) writePump() {
 	}
 }
 
-func (c *client) readPump() {
+// write send msg once, the sequenced one failed is replayed after reconnect
+func (c *Client) write(msg *connector.Message) bool {
+	msg.Ack = c.sess.lastProcessed()
+	s, err := msg.Serialize()
+	if err != nil {
+		log.Error().Err(err).Msg("message serialization failed")
+		return false
+	}
+
+	c.ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, s); err != nil {
+		log.Error().Err(err).Msg("websocket write failed")
+		return false
+	}
+
+	return true
+}
+
+// reopened replay the messages not acknowledged once connected again
+func (c *Client) reopened() {
+	select {
+	case c.resendCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) requestAck() {
+	select {
+	case c.ackCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) readPump() {
 	defer log.Info().Msg("read pump stop")
 	var readRetryCnt int64 = 0
 	for {
 		if !c.ws.CheckHealth() {
-			c.waitAndRetry(&readRetryCnt)
-		} else {
-			c.resetCounter(&readRetryCnt)
+			if !c.waitAndRetry(&readRetryCnt) {
+				return
+			}
+			continue
 		}
+		c.resetCounter(&readRetryCnt)
 
 		_, s, err := c.ws.ReadMessage()
 		if err != nil {
@@ -107,43 +245,111 @@ func (c *client) readPump() {
 			continue
 		}
 
-		// todo: 消息格式还需要定下
-		msg, err := connector.MessageBytes(s).Deserialize()
-		if err != nil {
-			log.Error().Err(err).Msg("message deserialization failed")
-			continue
+		if !c.read(s) {
+			return
+		}
+	}
+}
+
+// read handle a message of the platform, the ready ones are sent to dispatch in order.
+// It returns false once the client is stopped.
+func (c *Client) read(s []byte) bool {
+	// todo: 消息格式还需要定下
+	msg, err := connector.MessageBytes(s).Deserialize()
+	if err != nil {
+		log.Error().Err(err).Msg("message deserialization failed")
+		go c.Response("", connector.NewJsonMessage("", fmt.Sprintf("bad message: %s", err)))
+		seq := connector.MessageBytes(s).Seq()
+		if seq == 0 {
+			// it may be a sequenced one, the later ones would wait for it forever
+			log.Warn().Msg("[Client] the bad message has no seq, start a new session")
+			c.sess.reset()
+			c.ws.Reconnect()
+			return true
 		}
+		// skip it in order, a replay would fail again
+		msg = connector.Message{Type: badType, Seq: seq}
+	}
+
+	if msg.Ack > 0 {
+		c.sess.acked(msg.Ack)
+	}
+	if msg.Type == connector.AckType {
+		return true
+	}
+
+	ready := c.sess.receive(&msg)
+	if len(ready) == 0 && msg.Seq > 0 && msg.Seq <= c.sess.lastProcessed() {
+		// a replay of the processed one, the ack is lost
+		log.Debug().Msgf("[Client] drop duplicated message: %d", msg.Seq)
+		c.requestAck()
+	}
+	for _, m := range ready {
 		select {
-		case c.readCh <- &msg:
+		case c.readCh <- m:
 		case <-c.doneCh:
-			return
+			return false
 		}
 	}
+
+	return true
 }
 
-func (c *client) dispatch() {
+func (c *Client) dispatch() {
 	defer log.Info().Msg("dispatch stop")
 	log.Info().Msg("start dispatch")
 	for {
 		select {
 		case msg := <-c.readCh:
-			c.workerCh <- msg
+			ch := c.workerCh
+			if msg.Seq > 0 {
+				ch = c.seqCh
+			}
+			select {
+			case ch <- msg:
+			case <-c.doneCh:
+				return
+			}
+		case <-c.doneCh:
+			return
+		}
+	}
+}
+
+func (c *Client) worker(ch chan *connector.Message) {
+	for {
+		select {
+		case msg := <-ch:
+			log.Debug().Msgf("[Client] receive %s message, seq: %d, session: %s", msg.Type, msg.Seq, msg.Session)
+			if msg.Type != badType {
+				c.handler(msg)
+			}
+			if msg.Seq > 0 && c.sess.finish(msg.Seq) {
+				c.requestAck()
+			}
 		case <-c.doneCh:
 			return
 		}
 	}
 }
 
-func Stop() {
+func (c *Client) Stop() {
+	log.Info().Msgf("[Client] Stop.")
 	close(c.doneCh)
 	c.ws.Close()
 }
 
-func (c *client) response(session string, msg *connector.Message) {
+// Response send msg as the reply of session, it waits if too many messages are not acknowledged
+func (c *Client) Response(session string, msg *connector.Message) {
 	msg.Session = session
+	select {
+	case c.sess.window <- struct{}{}:
+	case <-c.doneCh:
+		return
+	}
+
 	select {
 	case c.writeCh <- msg:
-		// default:
-		// 	log.Error().Err(fmt.Errorf("write channel full")).Msg("client write error")
+	case <-c.doneCh:
 	}
 }
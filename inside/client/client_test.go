@@ -0,0 +1,193 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/connector"
+)
+
+// testClient run dispatch and the workers, the messages are given to read directly.
+// The handled seqs are sent to the returned channel.
+func testClient(t *testing.T) (*Client, chan uint64) {
+	handled := make(chan uint64, 64)
+	// nothing listens there, the connection is never open
+	c := newClient(connector.NewConn("ws://127.0.0.1:1", http.Header{}, nil, nil), func(msg *connector.Message) {
+		handled <- msg.Seq
+	})
+	for i := 0; i < numWorkers; i++ {
+		go c.worker(c.workerCh)
+	}
+	go c.worker(c.seqCh)
+	go c.dispatch()
+	t.Cleanup(c.Stop)
+
+	return c, handled
+}
+
+func serialize(t *testing.T, msg *connector.Message) []byte {
+	b, err := msg.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func sequenced(t *testing.T, seq uint64) []byte {
+	msg := connector.NewMessage(connector.CommandType, "", []byte("{}"))
+	msg.Seq = seq
+	return serialize(t, msg)
+}
+
+func expect(t *testing.T, handled chan uint64, want ...uint64) {
+	for _, w := range want {
+		select {
+		case got := <-handled:
+			if got != w {
+				t.Fatalf("handled %d, want %d", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d is not handled", w)
+		}
+	}
+	select {
+	case got := <-handled:
+		t.Fatalf("%d is handled more", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func waitProcessed(t *testing.T, c *Client, seq uint64) {
+	deadline := time.Now().Add(time.Second)
+	for c.sess.lastProcessed() != seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("processed %d, want %d", c.sess.lastProcessed(), seq)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func drainAck(c *Client) bool {
+	select {
+	case <-c.ackCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestReadOutOfOrder(t *testing.T) {
+	c, handled := testClient(t)
+	for _, seq := range []uint64{3, 2, 1, 4} {
+		c.read(sequenced(t, seq))
+	}
+
+	expect(t, handled, 1, 2, 3, 4)
+	waitProcessed(t, c, 4)
+	if !drainAck(c) {
+		t.Fatal("no ack is requested")
+	}
+}
+
+func TestReadDuplicate(t *testing.T) {
+	c, handled := testClient(t)
+	c.read(sequenced(t, 1))
+	expect(t, handled, 1)
+	waitProcessed(t, c, 1)
+	drainAck(c)
+
+	// the ack is lost, the platform replays it
+	c.read(sequenced(t, 1))
+	expect(t, handled)
+	if !drainAck(c) {
+		t.Fatal("the duplicate should be acknowledged again")
+	}
+}
+
+func TestReadBadWithSeq(t *testing.T) {
+	c, handled := testClient(t)
+	id := c.sess.id
+	c.read(sequenced(t, 1))
+	// the Type is not a string
+	c.read([]byte(`{"Seq":2,"Type":5}`))
+	c.read(sequenced(t, 3))
+
+	expect(t, handled, 1, 3)
+	waitProcessed(t, c, 3)
+	if c.sess.id != id {
+		t.Fatal("the session is reset")
+	}
+
+	select {
+	case msg := <-c.writeCh:
+		if msg.Type != connector.JsonType {
+			t.Fatalf("reply %s, want %s", msg.Type, connector.JsonType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the bad message is not replied")
+	}
+}
+
+func TestReadBadWithoutSeq(t *testing.T) {
+	c, handled := testClient(t)
+	id := c.sess.id
+	c.read(sequenced(t, 1))
+	expect(t, handled, 1)
+	waitProcessed(t, c, 1)
+
+	c.read([]byte("not a message"))
+	if c.sess.id == id {
+		t.Fatal("the session is not reset")
+	}
+	if c.sess.lastProcessed() != 0 {
+		t.Fatalf("processed %d, want 0", c.sess.lastProcessed())
+	}
+
+	// the new session numbers from 1 again
+	c.read(sequenced(t, 1))
+	expect(t, handled, 1)
+}
+
+func TestReadWindowFull(t *testing.T) {
+	c, handled := testClient(t)
+	for i := 0; i < windowSize; i++ {
+		c.sess.window <- struct{}{}
+		c.sess.track(connector.NewJsonMessage("", ""))
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		c.Response("", connector.NewJsonMessage("out", ""))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("the response is sent with the window full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the reader goes on while the window is full, and the ack frees it
+	read := make(chan struct{})
+	go func() {
+		c.read(sequenced(t, 1))
+		c.read(serialize(t, connector.NewAck(windowSize)))
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("the reader is blocked by the window")
+	}
+	expect(t, handled, 1)
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("the response is not sent once acknowledged")
+	}
+	if len(c.sess.resend()) != 0 {
+		t.Fatalf("unacked left: %d", len(c.sess.resend()))
+	}
+}
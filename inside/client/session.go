@@ -0,0 +1,153 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/bitrainforest/PandaAgent/inside/connector"
+)
+
+const (
+	// windowSize is the messages sent and not acknowledged yet, the senders wait once it is full
+	windowSize = 64
+
+	// HeaderSession and HeaderLastSeq resume the session on reconnect, the platform replays
+	// the messages after HeaderLastSeq and the client replays the ones not acknowledged
+	HeaderSession = "X-Agent-Session"
+	HeaderLastSeq = "X-Agent-Last-Seq"
+)
+
+// session numbers the messages both ways, so a reconnect resumes without loss or duplication.
+// It lives in memory, a restarted agent starts a new one.
+type session struct {
+	sync.Mutex
+	id string
+
+	// outSeq is the last Seq sent, unacked are the ones sent and not acknowledged in order
+	outSeq  uint64
+	unacked []*connector.Message
+	window  chan struct{}
+
+	// received is the last Seq handed to the handler, pending are the ones arrived ahead of a gap
+	received uint64
+	pending  map[uint64]*connector.Message
+	// processed is the last Seq all the ones before it are processed, done are the ones processed out of order
+	processed uint64
+	done      map[uint64]bool
+}
+
+func newSession() *session {
+	return &session{
+		id:      connector.NewID(),
+		window:  make(chan struct{}, windowSize),
+		pending: make(map[uint64]*connector.Message),
+		done:    make(map[uint64]bool),
+	}
+}
+
+// handshake add the headers to resume the session
+func (s *session) handshake(header http.Header) {
+	s.Lock()
+	defer s.Unlock()
+	header.Set(HeaderSession, s.id)
+	header.Set(HeaderLastSeq, strconv.FormatUint(s.processed, 10))
+}
+
+// track number msg and keep it until acknowledged
+func (s *session) track(msg *connector.Message) {
+	s.Lock()
+	defer s.Unlock()
+	s.outSeq++
+	msg.Seq = s.outSeq
+	if msg.ID == "" {
+		msg.ID = connector.NewID()
+	}
+	s.unacked = append(s.unacked, msg)
+}
+
+// acked drop the messages acknowledged and free their window
+func (s *session) acked(ack uint64) {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for n < len(s.unacked) && s.unacked[n].Seq <= ack {
+		n++
+	}
+	s.unacked = s.unacked[n:]
+	for i := 0; i < n; i++ {
+		<-s.window
+	}
+}
+
+// resend return the messages to replay after reconnect
+func (s *session) resend() []*connector.Message {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*connector.Message(nil), s.unacked...)
+}
+
+// receive return the messages ready to handle in order, the duplicated ones are dropped
+func (s *session) receive(msg *connector.Message) []*connector.Message {
+	if msg.Seq == 0 {
+		return []*connector.Message{msg}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if msg.Seq <= s.received || s.pending[msg.Seq] != nil {
+		return nil
+	}
+
+	if msg.Seq > s.received+1 {
+		s.pending[msg.Seq] = msg
+		return nil
+	}
+
+	ready := []*connector.Message{msg}
+	s.received = msg.Seq
+	for next := s.pending[s.received+1]; next != nil; next = s.pending[s.received+1] {
+		delete(s.pending, next.Seq)
+		ready = append(ready, next)
+		s.received = next.Seq
+	}
+
+	return ready
+}
+
+// finish mark the message processed, return true if processed moves on and an ack is needed
+func (s *session) finish(seq uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	s.done[seq] = true
+	moved := false
+	for s.done[s.processed+1] {
+		s.processed++
+		delete(s.done, s.processed)
+		moved = true
+	}
+
+	return moved
+}
+
+// reset start a new session, the messages not acknowledged are numbered again from 1 and
+// sent in the new one. The platform replays nothing of the old session to the new one.
+func (s *session) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.id = connector.NewID()
+	s.outSeq = 0
+	for _, msg := range s.unacked {
+		s.outSeq++
+		msg.Seq = s.outSeq
+	}
+	s.received, s.processed = 0, 0
+	s.pending = make(map[uint64]*connector.Message)
+	s.done = make(map[uint64]bool)
+}
+
+func (s *session) lastProcessed() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.processed
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/bitrainforest/PandaAgent/inside/connector"
+)
+
+func seqs(msgs []*connector.Message) []uint64 {
+	res := make([]uint64, 0, len(msgs))
+	for _, m := range msgs {
+		res = append(res, m.Seq)
+	}
+
+	return res
+}
+
+func equal(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestSessionReceive(t *testing.T) {
+	s := newSession()
+	for _, c := range []struct {
+		seq  uint64
+		want []uint64
+	}{
+		{3, nil},
+		{2, nil},
+		// a duplicate of the pending one
+		{3, nil},
+		{1, []uint64{1, 2, 3}},
+		// a duplicate of the received one
+		{2, nil},
+		{5, nil},
+		{4, []uint64{4, 5}},
+		{0, []uint64{0}},
+	} {
+		if got := seqs(s.receive(&connector.Message{Seq: c.seq})); !equal(got, c.want) {
+			t.Fatalf("receive %d: got %v, want %v", c.seq, got, c.want)
+		}
+	}
+	if len(s.pending) != 0 {
+		t.Fatalf("pending left: %d", len(s.pending))
+	}
+}
+
+func TestSessionFinish(t *testing.T) {
+	s := newSession()
+	for _, c := range []struct {
+		seq       uint64
+		moved     bool
+		processed uint64
+	}{
+		{2, false, 0},
+		{1, true, 2},
+		{4, false, 2},
+		{3, true, 4},
+	} {
+		if moved := s.finish(c.seq); moved != c.moved || s.lastProcessed() != c.processed {
+			t.Fatalf("finish %d: moved %v, processed %d, want %v, %d", c.seq, moved, s.lastProcessed(), c.moved, c.processed)
+		}
+	}
+}
+
+func TestSessionAck(t *testing.T) {
+	s := newSession()
+	for i := 0; i < 3; i++ {
+		s.window <- struct{}{}
+		s.track(connector.NewJsonMessage("", ""))
+	}
+
+	s.acked(2)
+	if got := seqs(s.resend()); !equal(got, []uint64{3}) {
+		t.Fatalf("resend: got %v", got)
+	}
+	if len(s.window) != 1 {
+		t.Fatalf("window: %d, want 1", len(s.window))
+	}
+
+	// an old ack frees nothing
+	s.acked(1)
+	if len(s.window) != 1 {
+		t.Fatalf("window: %d, want 1", len(s.window))
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	s := newSession()
+	for i := 0; i < 3; i++ {
+		s.window <- struct{}{}
+		s.track(connector.NewJsonMessage("", ""))
+	}
+	s.acked(1)
+	s.receive(&connector.Message{Seq: 1})
+	s.receive(&connector.Message{Seq: 3})
+	s.finish(1)
+	id := s.id
+
+	s.reset()
+	if s.id == id {
+		t.Fatal("the session id is kept")
+	}
+	if got := seqs(s.resend()); !equal(got, []uint64{1, 2}) {
+		t.Fatalf("the unacked are not numbered again: %v", got)
+	}
+	if s.lastProcessed() != 0 || len(s.pending) != 0 {
+		t.Fatalf("processed %d, pending %d", s.lastProcessed(), len(s.pending))
+	}
+	if got := seqs(s.receive(&connector.Message{Seq: 1})); !equal(got, []uint64{1}) {
+		t.Fatalf("the new session should start from 1: %v", got)
+	}
+}
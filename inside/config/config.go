@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/imdario/mergo"
@@ -22,105 +23,383 @@ const (
 // global app config variable
 var (
 	AppConfig Config
+	// flags is the config from command line
+	flags Config
+	mu    sync.RWMutex
 )
 
 type Config struct {
 	ConfigDir string `yaml:"-"`
 	Env       string `yaml:"-"`
-	Boost     struct {
-		APIToken   string `yaml:"APIToken"`
+	// ConfigFiles are merged after ConfigDir in order, the later one wins
+	ConfigFiles []string `yaml:"-"`
+	// Sets are key=value from --set flags, they win over the files and env variables
+	Sets []string `yaml:"-"`
+	// AgentID is read from Agent.IDFile at start
+	AgentID string `yaml:"-"`
+	Boost   struct {
+		APIToken   Secret `yaml:"APIToken"`
 		RPCURL     string `yaml:"RPCURL"`
 		GraphQlURL string `yaml:"GraphQlURL"`
 	} `yaml:"Boost"`
 	Transformer struct {
+		// MaxDownloader is the number of sectors processed at the same time
 		MaxDownloader            int    `yaml:"MaxParallelNumber"`
 		MaxDownloadRetry         int    `yaml:"MaxRetryNumber"`
 		TransformPartSize        int    `yaml:"SliceSize"`
 		SingleDownloadMaxWorkers int    `yaml:"MaxSliceNumber"`
 		WorkDir                  string `yaml:"WorkDir"`
+		// ShutdownTimeout is the grace period to drain in-flight sectors when stop
+		ShutdownTimeout time.Duration `yaml:"ShutdownTimeout"`
+		// MaxBandwidth limits the download speed of all sectors in bytes per second, 0 means no limit
+		MaxBandwidth int64 `yaml:"MaxBandwidth"`
+		// Source is the one in Sources the sectors are downloaded from by default, Platform.DownloadURL if empty
+		Source string `yaml:"Source"`
+		// Sources are where the sealing cluster parks the sectors, the platform may name one for a sector
+		Sources map[string]SourceConfig `yaml:"Sources"`
+		// MaxPerDisk limits the files downloading to one disk at the same time, 0 means no limit
+		MaxPerDisk int `yaml:"MaxPerDisk"`
+		// Stages are the workers of the steps after download, they run in parallel with the downloads
+		// of the other sectors, 2 for each by default
+		Stages struct {
+			Extract  int `yaml:"Extract"`
+			Declare  int `yaml:"Declare"`
+			Callback int `yaml:"Callback"`
+		} `yaml:"Stages"`
+		// QueueAging raises the priority of a waiting sector by one every period, 10m by default
+		QueueAging time.Duration `yaml:"QueueAging"`
+		// Mirrors serve the same files as Platform.DownloadURL, the parts of a file are spread across them
+		Mirrors []MirrorConfig `yaml:"Mirrors"`
 	} `yaml:"Transmission"`
 	Miner struct {
 		SealedPath      string `yaml:"StoreSealedPath"`
 		SealedCachePath string `yaml:"StoreCachePath"`
-		APIToken        string `yaml:"APIToken"`
+		APIToken        Secret `yaml:"APIToken"`
 		ID              string `yaml:"ID"`
 		StorageID       string `yaml:"StorageID"`
 		Address         string `yaml:"Address"`
+		// APIInfo is lotus style api info, like token:/ip4/127.0.0.1/tcp/2345/http
+		APIInfo string `yaml:"APIInfo"`
+		// APITokenFile is read again once it is modified
+		APITokenFile string `yaml:"APITokenFile"`
+		// Repo is the lotus-miner repo to read the api and token files from
+		Repo string `yaml:"Repo"`
+		// Discover the StorageID, StoreSealedPath and StoreCachePath from lotus-miner
+		Discover struct {
+			Enable bool `yaml:"Enable"`
+			// Label should be one of the Groups in sectorstore.json
+			Label  string `yaml:"Label"`
+			Weight uint64 `yaml:"Weight"`
+		} `yaml:"Discover"`
 	} `yaml:"Miner"`
 	Log struct {
 		Level string `yaml:"Level"`
 		Dir   string `yaml:"Dir"`
 	} `yaml:"Log"`
 	GH struct {
-		QueryURL       string        `yaml:"QueryURL"`
-		CallBack       string        `yaml:"CallBack"`
-		DealURL        string        `yaml:"DealURL"`
-		DownloadURL    string        `yaml:"DownloadURL"`
-		Timeout        int           `yaml:"Timeout"`
-		PingURL        string        `yaml:"HeartURL"`
+		QueryURL    string `yaml:"QueryURL"`
+		CallBack    string `yaml:"CallBack"`
+		DealURL     string `yaml:"DealURL"`
+		DownloadURL string `yaml:"DownloadURL"`
+		Timeout     int    `yaml:"Timeout"`
+		PingURL     string `yaml:"HeartURL"`
+		// RegisterURL is where the agent registers itself at start, empty means not register
+		RegisterURL    string        `yaml:"RegisterURL"`
 		CheckFrequency time.Duration `yaml:"CheckFrequency"`
 		HeartFrequency time.Duration `yaml:"HeartFrequency"`
 		DealFrequency  time.Duration `yaml:"DealFrequency"`
-		Token          string        `yaml:"Token"`
+		Token          Secret        `yaml:"Token"`
 	} `yaml:"Platform"`
+	TLS struct {
+		// CAFile is a pem bundle trusted besides the system roots
+		CAFile string `yaml:"CAFile"`
+		// CertFile and KeyFile are the client certificate for mutual tls
+		CertFile string `yaml:"CertFile"`
+		KeyFile  string `yaml:"KeyFile"`
+		// MinVersion is 1.2 or 1.3, 1.2 by default
+		MinVersion string `yaml:"MinVersion"`
+		// PinnedKeys are the base64 sha256 of the platform certificate public keys, like sha256/AAAA...=
+		PinnedKeys []string `yaml:"PinnedKeys"`
+		// Insecure skips the certificate verification, only for test
+		Insecure bool `yaml:"Insecure"`
+	} `yaml:"TLS"`
+	HTTP struct {
+		// Proxy is used for all the endpoints, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used if empty
+		Proxy string `yaml:"Proxy"`
+		// NoProxy is the comma separated hosts not use Proxy, like NO_PROXY
+		NoProxy      string        `yaml:"NoProxy"`
+		KeepAlive    time.Duration `yaml:"KeepAlive"`
+		DisableHTTP2 bool          `yaml:"DisableHTTP2"`
+		// Headers are added to every request
+		Headers map[string]string `yaml:"Headers"`
+		// Endpoints override the defaults of platform, download, boost and miner, zero means default
+		Endpoints map[string]HTTPEndpoint `yaml:"Endpoints"`
+	} `yaml:"HTTP"`
+	Secrets struct {
+		// PrivateKey decrypts the enc: secrets, private.pem beside the configuration file by default
+		PrivateKey string `yaml:"PrivateKey"`
+	} `yaml:"Secrets"`
+	Agent struct {
+		// IDFile keeps the agent id, agent.id beside the configuration file by default
+		IDFile string `yaml:"IDFile"`
+	} `yaml:"Agent"`
+	Admin struct {
+		// Address the admin api listen on, like 127.0.0.1:6061, empty means disabled
+		Address string `yaml:"Address"`
+		// Token is required in the Authorization: Bearer header, it must be set unless Address is a loopback one
+		Token Secret `yaml:"Token"`
+	} `yaml:"Admin"`
+	Connector struct {
+		// URL is the websocket the platform pushes the sectors and configuration on, like wss://host/websocket.
+		// Platform.QueryURL is polled while it is down, empty means polling only
+		URL string `yaml:"URL"`
+		// IdentityKey is the private key the agent authenticates with, the handshake and the platform requests
+		// are signed by it. agent.key beside the configuration file by default, an ed25519 one is created on first run
+		IdentityKey string `yaml:"IdentityKey"`
+		// ServerKeys are the pem public keys of the platform, the platform must prove it holds one of them
+		ServerKeys []string `yaml:"ServerKeys"`
+		// Shell are the command lines the shell module may run and Python the ones of the scripts the python
+		// module may run, like "df -h /data" or "check.py *". A * matches one argument not starting with -,
+		// the others must be the same. The modules are disabled if empty
+		Shell  []string `yaml:"Shell"`
+		Python []string `yaml:"Python"`
+	} `yaml:"Connector"`
 }
 
-// Init parse the yaml configuration file
+// the types of the sector sources
+const (
+	SourceHTTP = "http"
+	SourceS3   = "s3"
+	SourceFS   = "fs"
+	SourceSFTP = "sftp"
+)
+
+// SourceConfig is a place to download the sectors from, all of them keep the files in the layout of
+// the platform: sealedsectors/<miner>/<sector> and sectortree/<miner>/32/<sector>
+type SourceConfig struct {
+	// Type is http, s3, fs or sftp
+	Type string `yaml:"Type"`
+	// URL is the base url for http, the endpoint for s3 like http://127.0.0.1:9000,
+	// or sftp://user@host:22/path for sftp
+	URL string `yaml:"URL"`
+	// Token is sent in the Token header for http
+	Token Secret `yaml:"Token"`
+	// Bucket, Prefix, Region, AccessKey and SecretKey are for s3, Region is us-east-1 by default
+	Bucket    string `yaml:"Bucket"`
+	Prefix    string `yaml:"Prefix"`
+	Region    string `yaml:"Region"`
+	AccessKey Secret `yaml:"AccessKey"`
+	SecretKey Secret `yaml:"SecretKey"`
+	// Path is the directory for fs, like a nfs mount
+	Path string `yaml:"Path"`
+	// Password or KeyFile authorize the sftp user, the host key is checked with KnownHosts
+	Password   Secret `yaml:"Password"`
+	KeyFile    string `yaml:"KeyFile"`
+	KnownHosts string `yaml:"KnownHosts"`
+	// InsecureIgnoreHostKey skips the host key check of sftp, only for test
+	InsecureIgnoreHostKey bool `yaml:"InsecureIgnoreHostKey"`
+}
+
+// MirrorConfig is a mirror of the platform file server
+type MirrorConfig struct {
+	URL string `yaml:"URL"`
+	// Priority is 0 for Platform.DownloadURL, the higher ones are used first,
+	// and the lower ones only when all the higher ones are failing
+	Priority int `yaml:"Priority"`
+}
+
+// the endpoints have their own http client settings
+const (
+	EndpointPlatform = "platform"
+	EndpointDownload = "download"
+	EndpointBoost    = "boost"
+	EndpointMiner    = "miner"
+)
+
+// HTTPEndpoint is the client settings of an endpoint
+type HTTPEndpoint struct {
+	Timeout               time.Duration `yaml:"Timeout"`
+	DialTimeout           time.Duration `yaml:"DialTimeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"TLSHandshakeTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"ResponseHeaderTimeout"`
+	IdleConnTimeout       time.Duration `yaml:"IdleConnTimeout"`
+	MaxIdleConns          int           `yaml:"MaxIdleConns"`
+	MaxIdleConnsPerHost   int           `yaml:"MaxIdleConnsPerHost"`
+	MaxConnsPerHost       int           `yaml:"MaxConnsPerHost"`
+}
+
+// Init parse the yaml configuration file and validate it
 func Init(ctx *cli.Context) error {
-	if AppConfig.ConfigDir != "" {
-		if err := parseYAMLFile(AppConfig.ConfigDir); err != nil {
-			panic(err)
-		}
+	conf, err := Parse(ctx)
+	if err != nil {
+		return err
 	}
 
-	if AppConfig.GH.QueryURL == "" {
-		AppConfig.GH.QueryURL = os.Getenv(ENV_PANDA_PLATFORM_DOWNLOAD_QUERY)
+	if err := Validate(conf); err != nil {
+		return err
 	}
 
-	if AppConfig.GH.CallBack == "" {
-		AppConfig.GH.CallBack = os.Getenv(ENV_PANDA_PLATFORM_DOWNLOAD_CALLBACK)
+	mu.Lock()
+	AppConfig = conf
+	mu.Unlock()
+	return nil
+}
+
+// SetAgentID keep the agent id in the global config, and in the reloaded ones
+func SetAgentID(id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	AppConfig.AgentID = id
+	flags.AgentID = id
+}
+
+// SetStorage keep the storage discovered from lotus-miner in the global config
+func SetStorage(storageID, sealedPath, cachePath string) {
+	mu.Lock()
+	defer mu.Unlock()
+	AppConfig.Miner.StorageID = storageID
+	AppConfig.Miner.SealedPath = sealedPath
+	AppConfig.Miner.SealedCachePath = cachePath
+}
+
+// Parse build the configuration without validation, the global config is not changed
+func Parse(ctx *cli.Context) (Config, error) {
+	if ctx != nil {
+		AppConfig.ConfigFiles = ctx.StringSlice("config")
+		AppConfig.Sets = ctx.StringSlice("set")
+	}
+
+	// keep the values from command line, they are the base when reload
+	flags = AppConfig
+	return load(flags)
+}
+
+// ParseFiles build the configuration only from the configuration files
+func ParseFiles(ctx *cli.Context) (Config, error) {
+	if ctx != nil {
+		AppConfig.ConfigFiles = ctx.StringSlice("config")
+	}
+
+	return loadFiles(AppConfig)
+}
+
+// load build the configuration in order of: the configuration files, the PANDA_* env variables,
+// the values pushed by the platform, the --set flags and the other command line flags, the later one wins.
+// The ENV_PANDA_* env variables are only used if the field is still empty.
+func load(base Config) (Config, error) {
+	conf, err := loadFiles(base)
+	if err != nil {
+		return conf, err
 	}
 
-	if AppConfig.GH.DownloadURL == "" {
-		AppConfig.GH.DownloadURL = os.Getenv(ENV_PANDA_PLATFORM_DOWNLOAD)
+	if err := applyEnv(&conf); err != nil {
+		return conf, err
 	}
 
-	if AppConfig.GH.PingURL == "" {
-		AppConfig.GH.PingURL = os.Getenv(ENV_PANDA_PLATFORM_HEART)
+	if err := applySets(&conf, Pushed()); err != nil {
+		return conf, err
 	}
 
-	if AppConfig.Log.Dir == "" {
-		AppConfig.Log.Dir = os.Getenv(ENV_PANDA_LOGDIR_DEFAULT)
+	if err := applySets(&conf, base.Sets); err != nil {
+		return conf, err
 	}
 
-	return nil
+	if err := resolveSecrets(&conf); err != nil {
+		return conf, err
+	}
+
+	if base.Log.Dir != "" {
+		conf.Log.Dir = base.Log.Dir
+	}
+
+	if conf.GH.QueryURL == "" {
+		conf.GH.QueryURL = os.Getenv(ENV_PANDA_PLATFORM_DOWNLOAD_QUERY)
+	}
+
+	if conf.GH.CallBack == "" {
+		conf.GH.CallBack = os.Getenv(ENV_PANDA_PLATFORM_DOWNLOAD_CALLBACK)
+	}
+
+	if conf.GH.DownloadURL == "" {
+		conf.GH.DownloadURL = os.Getenv(ENV_PANDA_PLATFORM_DOWNLOAD)
+	}
+
+	if conf.GH.PingURL == "" {
+		conf.GH.PingURL = os.Getenv(ENV_PANDA_PLATFORM_HEART)
+	}
+
+	if conf.Log.Dir == "" {
+		conf.Log.Dir = os.Getenv(ENV_PANDA_LOGDIR_DEFAULT)
+	}
+
+	return conf, nil
+}
+
+// Files return the configuration files in merge order
+func (c Config) Files() []string {
+	files := make([]string, 0, len(c.ConfigFiles)+1)
+	if c.ConfigDir != "" {
+		files = append(files, c.ConfigDir)
+	}
+
+	return append(files, c.ConfigFiles...)
 }
 
-func parseYAMLFile(filePath string) error {
-	if AppConfig.Env == "" {
-		AppConfig.Env = "Default"
+// loadFiles merge the env section of every configuration file in order, the later one wins
+func loadFiles(base Config) (Config, error) {
+	conf := Config{
+		ConfigDir:   base.ConfigDir,
+		Env:         base.Env,
+		ConfigFiles: base.ConfigFiles,
+		Sets:        base.Sets,
+		AgentID:     base.AgentID,
+	}
+	if conf.Env == "" {
+		conf.Env = "Default"
+	}
+
+	files := conf.Files()
+	found := false
+	for _, file := range files {
+		ok, err := parseYAMLFile(&conf, file)
+		if err != nil {
+			return conf, fmt.Errorf("%s: %s", file, err)
+		}
+		found = found || ok
+	}
+
+	if len(files) > 0 && !found {
+		return conf, fmt.Errorf("no %s env defined in configuration files %v", conf.Env, files)
 	}
 
+	return conf, nil
+}
+
+// parseYAMLFile merge the env section of the file into conf, return false if the file has no such section
+func parseYAMLFile(conf *Config, filePath string) (bool, error) {
 	var data map[string]Config
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if err := yaml.Unmarshal(content, &data); err != nil {
-		return err
+		return false, err
 	}
 
-	if conf, ok := data[AppConfig.Env]; ok {
-		if err := mergo.Merge(&AppConfig, conf); err != nil {
-			return err
-		}
-	} else {
-		return fmt.Errorf("no %s env defined in configuration file", AppConfig.Env)
+	c, ok := data[conf.Env]
+	if !ok {
+		return false, nil
 	}
-	return nil
+
+	if err := mergo.Merge(conf, c, mergo.WithOverride); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // GetConfig return the config
 func GetConfig() Config {
+	mu.RLock()
+	defer mu.RUnlock()
 	return AppConfig
 }
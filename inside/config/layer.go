@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix of the env variables overriding the configuration, like PANDA_PLATFORM_QUERYURL
+	EnvPrefix = "PANDA"
+)
+
+// Field is a leaf of Config addressed by the yaml names of its path, like Platform.QueryURL
+type Field struct {
+	Path  []string
+	Value reflect.Value
+	Tag   reflect.StructTag
+}
+
+func (f Field) Key() string {
+	return strings.Join(f.Path, ".")
+}
+
+// EnvName is the env variable overrides this field, like PANDA_PLATFORM_QUERYURL
+func (f Field) EnvName() string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.Join(f.Path, "_"))
+}
+
+// Set parse s into the field, scalars are parsed directly and the others as yaml
+func (f Field) Set(s string) error {
+	if f.Value.Kind() == reflect.String {
+		f.Value.SetString(s)
+		return nil
+	}
+
+	ptr := reflect.New(f.Value.Type())
+	if err := yaml.Unmarshal([]byte(s), ptr.Interface()); err != nil {
+		return fmt.Errorf("%s: can not parse %q as %s: %s", f.Key(), s, f.Value.Type(), err)
+	}
+
+	f.Value.Set(ptr.Elem())
+	return nil
+}
+
+// Fields return all the leaves of conf in order, they can be set to change conf
+func Fields(conf *Config) []Field {
+	return walk(reflect.ValueOf(conf).Elem(), nil)
+}
+
+func walk(v reflect.Value, path []string) []Field {
+	res := make([]Field, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		if name == "-" || sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+
+		p := append(append([]string{}, path...), name)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && !isLeaf(fv.Type()) {
+			res = append(res, walk(fv, p)...)
+			continue
+		}
+
+		res = append(res, Field{Path: p, Value: fv, Tag: sf.Tag})
+	}
+
+	return res
+}
+
+// isLeaf is the struct types set as a whole, they have their own yaml format
+func isLeaf(t reflect.Type) bool {
+	_, ok := reflect.New(t).Interface().(yaml.Unmarshaler)
+	return ok
+}
+
+// LookupField find the field by key like Platform.QueryURL, case insensitive
+func LookupField(conf *Config, key string) (Field, bool) {
+	for _, f := range Fields(conf) {
+		if strings.EqualFold(f.Key(), key) {
+			return f, true
+		}
+	}
+
+	return Field{}, false
+}
+
+// setKey return the key of a key=value, keys differ only in case are the same one
+func setKey(kv string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(kv, "=", 2)[0]))
+}
+
+// applyEnv override the fields with the env variables set
+func applyEnv(conf *Config) error {
+	for _, f := range Fields(conf) {
+		if s, ok := os.LookupEnv(f.EnvName()); ok {
+			if err := f.Set(s); err != nil {
+				return fmt.Errorf("env %s: %s", f.EnvName(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applySets override the fields with key=value from --set flags
+func applySets(conf *Config, sets []string) error {
+	for _, kv := range sets {
+		sp := strings.SplitN(kv, "=", 2)
+		if len(sp) != 2 {
+			return fmt.Errorf("--set %q should be key=value", kv)
+		}
+
+		f, ok := LookupField(conf, strings.TrimSpace(sp[0]))
+		if !ok {
+			return fmt.Errorf("--set %q: unknown key %s", kv, sp[0])
+		}
+
+		if err := f.Set(sp[1]); err != nil {
+			return fmt.Errorf("--set %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+)
+
+// pushable are the tuning fields the platform may push, the urls, tokens, keys and paths
+// are only changed by the operator
+var pushable = []string{
+	"Platform.CheckFrequency",
+	"Platform.HeartFrequency",
+	"Platform.DealFrequency",
+	"Transmission.MaxParallelNumber",
+	"Transmission.MaxRetryNumber",
+	"Transmission.SliceSize",
+	"Transmission.MaxSliceNumber",
+	"Transmission.MaxBandwidth",
+	"Transmission.MaxPerDisk",
+	"Transmission.QueueAging",
+	"Transmission.ShutdownTimeout",
+	"Log.Level",
+}
+
+var (
+	// pushed are the key=value the platform pushes over the connector, the later one of a key wins
+	pushed   []string
+	pushedMu sync.Mutex
+)
+
+// Push keep the key=value from the platform, they are applied on next Reload.
+// They win over the files and env variables, but not the --set flags.
+func Push(sets []string) error {
+	for _, kv := range sets {
+		if !Pushable(setKey(kv)) {
+			return fmt.Errorf("%q can not be pushed by the platform", kv)
+		}
+	}
+
+	conf := GetConfig()
+	if err := applySets(&conf, sets); err != nil {
+		return err
+	}
+
+	if err := Validate(conf); err != nil {
+		return err
+	}
+
+	pushedMu.Lock()
+	defer pushedMu.Unlock()
+	for _, kv := range sets {
+		key := setKey(kv)
+		for i, old := range pushed {
+			if setKey(old) == key {
+				pushed = append(pushed[:i], pushed[i+1:]...)
+				break
+			}
+		}
+		pushed = append(pushed, kv)
+	}
+
+	return nil
+}
+
+// Pushable return true if the platform may push the key, case insensitive
+func Pushable(key string) bool {
+	for _, k := range pushable {
+		if setKey(k) == setKey(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pushed return the key=value the platform pushed
+func Pushed() []string {
+	pushedMu.Lock()
+	defer pushedMu.Unlock()
+	return append([]string(nil), pushed...)
+}
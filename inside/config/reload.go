@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// restartFields can not be changed by reload, the agent must restart to apply them
+var restartFields = []struct {
+	name string
+	// field return the pointer to the field
+	field func(c *Config) interface{}
+}{
+	{"Miner.ID", func(c *Config) interface{} { return &c.Miner.ID }},
+	{"Miner.StorageID", func(c *Config) interface{} { return &c.Miner.StorageID }},
+	{"Miner.StoreSealedPath", func(c *Config) interface{} { return &c.Miner.SealedPath }},
+	{"Miner.StoreCachePath", func(c *Config) interface{} { return &c.Miner.SealedCachePath }},
+	{"Miner.Address", func(c *Config) interface{} { return &c.Miner.Address }},
+	// the miner and boost clients are built with them at start
+	{"Miner.APIToken", func(c *Config) interface{} { return &c.Miner.APIToken }},
+	{"Miner.APITokenFile", func(c *Config) interface{} { return &c.Miner.APITokenFile }},
+	{"Miner.APIInfo", func(c *Config) interface{} { return &c.Miner.APIInfo }},
+	{"Miner.Repo", func(c *Config) interface{} { return &c.Miner.Repo }},
+	{"Boost", func(c *Config) interface{} { return &c.Boost }},
+	{"Transmission.WorkDir", func(c *Config) interface{} { return &c.Transformer.WorkDir }},
+	{"Transmission.Stages", func(c *Config) interface{} { return &c.Transformer.Stages }},
+	// the sources may hold connections
+	{"Transmission.Sources", func(c *Config) interface{} { return &c.Transformer.Sources }},
+	{"Log.Dir", func(c *Config) interface{} { return &c.Log.Dir }},
+	// the clients are built with them at start
+	{"TLS", func(c *Config) interface{} { return &c.TLS }},
+	{"HTTP", func(c *Config) interface{} { return &c.HTTP }},
+	{"Connector", func(c *Config) interface{} { return &c.Connector }},
+	// the admin api listens with them at start
+	{"Admin", func(c *Config) interface{} { return &c.Admin }},
+}
+
+// Reload read the configuration file again for the current env and replace the global config.
+// The fields need restart keep their running values, and are returned as rejected messages.
+func Reload() (Config, []string, error) {
+	conf, err := load(flags)
+	if err != nil {
+		return GetConfig(), nil, err
+	}
+
+	if err := Validate(conf); err != nil {
+		return GetConfig(), nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if conf.Miner.Discover.Enable && AppConfig.Miner.Discover.Enable {
+		// these are discovered from lotus-miner, not from the file
+		conf.Miner.StorageID = AppConfig.Miner.StorageID
+		conf.Miner.SealedPath = AppConfig.Miner.SealedPath
+		conf.Miner.SealedCachePath = AppConfig.Miner.SealedCachePath
+	}
+
+	rejected := make([]string, 0)
+	for _, f := range restartFields {
+		running, reloaded := reflect.ValueOf(f.field(&AppConfig)).Elem(), reflect.ValueOf(f.field(&conf)).Elem()
+		if !reflect.DeepEqual(running.Interface(), reloaded.Interface()) {
+			// the values may hold tokens, like HTTP.Headers
+			rejected = append(rejected, fmt.Sprintf("%s changed, need restart", f.name))
+			reloaded.Set(running)
+		}
+	}
+
+	AppConfig = conf
+	return conf, rejected, nil
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+)
+
+const (
+	// SecretFilePrefix reads the secret from a file, like file:/run/secrets/token
+	SecretFilePrefix = "file:"
+	// SecretEnvPrefix reads the secret from an env variable, like env:PANDA_TOKEN
+	SecretEnvPrefix = "env:"
+	// SecretEncPrefix is a secret encrypted by `panda secrets encrypt`, like enc:base64
+	SecretEncPrefix = "enc:"
+
+	redacted = "******"
+
+	DefaultPrivateKey = "private.pem"
+	// DefaultIdentityKey is the key the agent authenticates with, beside the configuration file
+	DefaultIdentityKey = "agent.key"
+	DefaultAgentIDFile = "agent.id"
+	DefaultPublicKey   = "public.pem"
+)
+
+var secretType = reflect.TypeOf(Secret(""))
+
+// Secret is a sensitive value like token, it never prints or marshals its value.
+// In configuration it may be the value itself, or a reference: file:<path>, env:<name> or enc:<base64>.
+type Secret string
+
+// Value return the plain value, never log it
+func (s Secret) Value() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+
+	return redacted
+}
+
+// GoString is used by %#v
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// MarshalYAML keeps the references readable, they are not secret
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if s.isReference() {
+		return string(s), nil
+	}
+
+	return s.String(), nil
+}
+
+func (s Secret) isReference() bool {
+	for _, prefix := range []string{SecretFilePrefix, SecretEnvPrefix, SecretEncPrefix} {
+		if strings.HasPrefix(string(s), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve read the value the secret refers to, privateKey is used for the encrypted one
+func (s Secret) resolve(privateKey string) (Secret, error) {
+	ref := string(s)
+	switch {
+	case strings.HasPrefix(ref, SecretFilePrefix):
+		b, err := os.ReadFile(util.ExpandHome(strings.TrimPrefix(ref, SecretFilePrefix)))
+		if err != nil {
+			return "", err
+		}
+		return Secret(strings.TrimSpace(string(b))), nil
+	case strings.HasPrefix(ref, SecretEnvPrefix):
+		name := strings.TrimPrefix(ref, SecretEnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("env %s not set", name)
+		}
+		return Secret(v), nil
+	case strings.HasPrefix(ref, SecretEncPrefix):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ref, SecretEncPrefix))
+		if err != nil {
+			return "", fmt.Errorf("bad encrypted secret: %s", err)
+		}
+		plain, err := util.DecryptRSALong(b, privateKey)
+		if err != nil {
+			return "", fmt.Errorf("decrypt with %s err: %s", privateKey, err)
+		}
+		return Secret(plain), nil
+	}
+
+	return s, nil
+}
+
+// EncryptSecret encrypt the value with the rsa public key, the result can be used as a Secret in configuration
+func EncryptSecret(value, publicKey string) (string, error) {
+	b, err := util.EncryptRSALong([]byte(value), publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	return SecretEncPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Dir is the directory of the configuration file, keys are stored there by default
+func (c Config) Dir() string {
+	if c.ConfigDir == "" {
+		return "."
+	}
+
+	return filepath.Dir(c.ConfigDir)
+}
+
+// PrivateKey is the rsa key to decrypt the secrets
+func (c Config) PrivateKey() string {
+	if c.Secrets.PrivateKey != "" {
+		return util.ExpandHome(c.Secrets.PrivateKey)
+	}
+
+	return filepath.Join(c.Dir(), DefaultPrivateKey)
+}
+
+// AgentIDFile return the file keeps the agent id
+func (c Config) AgentIDFile() string {
+	if c.Agent.IDFile != "" {
+		return util.ExpandHome(c.Agent.IDFile)
+	}
+
+	return filepath.Join(c.Dir(), DefaultAgentIDFile)
+}
+
+// IdentityKey return the private key the agent authenticates with
+func (c Config) IdentityKey() string {
+	if c.Connector.IdentityKey != "" {
+		return util.ExpandHome(c.Connector.IdentityKey)
+	}
+
+	return filepath.Join(c.Dir(), DefaultIdentityKey)
+}
+
+// resolveSecrets replace all the secret references with their values
+func resolveSecrets(conf *Config) error {
+	for _, f := range Fields(conf) {
+		if f.Value.Type() != secretType {
+			continue
+		}
+
+		v, err := Secret(f.Value.String()).resolve(conf.PrivateKey())
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Key(), err)
+		}
+		f.Value.SetString(string(v))
+	}
+
+	// the sources are a map, Fields do not walk into it
+	for name, src := range conf.Transformer.Sources {
+		for key, secret := range map[string]*Secret{"Token": &src.Token, "AccessKey": &src.AccessKey,
+			"SecretKey": &src.SecretKey, "Password": &src.Password} {
+			v, err := secret.resolve(conf.PrivateKey())
+			if err != nil {
+				return fmt.Errorf("Transmission.Sources.%s.%s: %s", name, key, err)
+			}
+			*secret = v
+		}
+		conf.Transformer.Sources[name] = src
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+const PinPrefix = "sha256/"
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ClientTLS build the tls config of the outbound clients from the TLS section
+func ClientTLS(conf Config) (*tls.Config, error) {
+	tc, err := buildTLS(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc.InsecureSkipVerify {
+		log.Warn().Msgf("[TLS] TLS.Insecure is set, the certificates are NOT verified and the traffic can be intercepted")
+	}
+
+	return tc, nil
+}
+
+func buildTLS(conf Config) (*tls.Config, error) {
+	version, ok := tlsVersions[conf.TLS.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("TLS.MinVersion: %q should be 1.2 or 1.3", conf.TLS.MinVersion)
+	}
+
+	tc := &tls.Config{
+		MinVersion: version,
+	}
+
+	if conf.TLS.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(util.ExpandHome(conf.TLS.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("TLS.CAFile: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS.CAFile: no certificate found in %s", conf.TLS.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if conf.TLS.CertFile != "" || conf.TLS.KeyFile != "" {
+		if conf.TLS.CertFile == "" || conf.TLS.KeyFile == "" {
+			return nil, fmt.Errorf("TLS.CertFile and TLS.KeyFile should be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(util.ExpandHome(conf.TLS.CertFile), util.ExpandHome(conf.TLS.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(conf.TLS.PinnedKeys) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range conf.TLS.PinnedKeys {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, PinPrefix))
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("TLS.PinnedKeys: %q should be sha256/ with a base64 sha256 digest", pin)
+			}
+			pins[base64.StdEncoding.EncodeToString(b)] = true
+		}
+		tc.VerifyConnection = pinnedVerifier(platformHosts(conf), pins)
+	}
+
+	tc.InsecureSkipVerify = conf.TLS.Insecure
+
+	return tc, nil
+}
+
+// platformHosts are the hosts of the platform urls, the pins only apply to them
+func platformHosts(conf Config) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, u := range []string{conf.GH.QueryURL, conf.GH.CallBack, conf.GH.DealURL, conf.GH.DownloadURL, conf.GH.PingURL, conf.Connector.URL} {
+		if pu, err := url.Parse(u); err == nil && pu.Hostname() != "" {
+			hosts[strings.ToLower(pu.Hostname())] = true
+		}
+	}
+
+	return hosts
+}
+
+// pinnedVerifier check one of the certificates the platform hosts present has a pinned public key,
+// it runs even if the verification is skipped.
+func pinnedVerifier(hosts, pins map[string]bool) func(tls.ConnectionState) error {
+	// the server name is empty when dial an ip, pin them all if the platform is addressed by ip
+	pinIP := false
+	for h := range hosts {
+		pinIP = pinIP || net.ParseIP(h) != nil
+	}
+
+	return func(cs tls.ConnectionState) error {
+		name := strings.ToLower(cs.ServerName)
+		if !hosts[name] && !(name == "" && pinIP) {
+			return nil
+		}
+
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("platform certificate of %q does not match the pinned keys", cs.ServerName)
+	}
+}
@@ -0,0 +1,285 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/rs/zerolog"
+)
+
+var minerIDFormat = regexp.MustCompile(`^[tf]0[0-9]+$`)
+
+// ValidationError reports all the problems of a configuration at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d configuration problems:\n\t%s", len(e.Problems), strings.Join(e.Problems, "\n\t"))
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// url check the value is an absolute http(s) url, empty is a problem only if required
+func (v *validator) url(name, value string, required bool) {
+	if value == "" {
+		if required {
+			v.addf("%s is required", name)
+		}
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		v.addf("%s: %q is not a valid url: %s", name, value, err)
+		return
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.addf("%s: %q should be an absolute http or https url", name, value)
+	}
+}
+
+// loopback return true if host only accepts local connections, an empty host listens on all
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (v *validator) positive(name string, value int64) {
+	if value <= 0 {
+		v.addf("%s must be positive, got %d", name, value)
+	}
+}
+
+func (v *validator) notNegative(name string, value int64) {
+	if value < 0 {
+		v.addf("%s can not be negative, got %d", name, value)
+	}
+}
+
+// writableDir check the directory exists and we can create files in it
+func (v *validator) writableDir(name, dir string) {
+	if dir == "" {
+		v.addf("%s is required", name)
+		return
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		v.addf("%s: %s", name, err)
+		return
+	}
+
+	if !fi.IsDir() {
+		v.addf("%s: %s is not a directory", name, dir)
+		return
+	}
+
+	f, err := os.CreateTemp(dir, ".panda-check-*")
+	if err != nil {
+		v.addf("%s: %s is not writable: %s", name, dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (v *validator) source(name string, src SourceConfig) {
+	switch src.Type {
+	case SourceHTTP:
+		v.url(name+".URL", src.URL, true)
+		if src.URL != "" && !strings.HasSuffix(src.URL, "/") {
+			v.addf("%s.URL: %q should end with /", name, src.URL)
+		}
+	case SourceS3:
+		v.url(name+".URL", src.URL, true)
+		if src.Bucket == "" {
+			v.addf("%s.Bucket is required", name)
+		}
+		if src.AccessKey == "" || src.SecretKey == "" {
+			v.addf("%s.AccessKey and %s.SecretKey are required", name, name)
+		}
+	case SourceFS:
+		if fi, err := os.Stat(src.Path); err != nil {
+			v.addf("%s.Path: %s", name, err)
+		} else if !fi.IsDir() {
+			v.addf("%s.Path: %s is not a directory", name, src.Path)
+		}
+	case SourceSFTP:
+		u, err := url.Parse(src.URL)
+		if err != nil || u.Scheme != "sftp" || u.Host == "" || u.User == nil {
+			v.addf("%s.URL: %q should be like sftp://user@host:22/path", name, src.URL)
+		}
+		if src.Password == "" && src.KeyFile == "" {
+			v.addf("%s: Password or KeyFile is required", name)
+		}
+		if src.KnownHosts == "" && !src.InsecureIgnoreHostKey {
+			v.addf("%s.KnownHosts is required unless InsecureIgnoreHostKey", name)
+		}
+	default:
+		v.addf("%s.Type: %q should be http, s3, fs or sftp", name, src.Type)
+	}
+}
+
+// Validate check every field of the configuration, and return a *ValidationError with all the problems found.
+func Validate(conf Config) error {
+	v := &validator{}
+
+	// Platform
+	v.url("Platform.QueryURL", conf.GH.QueryURL, true)
+	v.url("Platform.CallBack", conf.GH.CallBack, true)
+	v.url("Platform.DealURL", conf.GH.DealURL, true)
+	v.url("Platform.DownloadURL", conf.GH.DownloadURL, true)
+	v.url("Platform.HeartURL", conf.GH.PingURL, true)
+	v.url("Platform.RegisterURL", conf.GH.RegisterURL, false)
+	if conf.GH.DownloadURL != "" && !strings.HasSuffix(conf.GH.DownloadURL, "/") {
+		v.addf("Platform.DownloadURL: %q should end with /", conf.GH.DownloadURL)
+	}
+	v.positive("Platform.Timeout", int64(conf.GH.Timeout))
+	v.positive("Platform.CheckFrequency", int64(conf.GH.CheckFrequency))
+	v.positive("Platform.HeartFrequency", int64(conf.GH.HeartFrequency))
+	v.positive("Platform.DealFrequency", int64(conf.GH.DealFrequency))
+	if conf.GH.Token == "" {
+		v.addf("Platform.Token is required")
+	}
+
+	// Boost
+	v.url("Boost.RPCURL", conf.Boost.RPCURL, true)
+	v.url("Boost.GraphQlURL", conf.Boost.GraphQlURL, true)
+
+	// Transmission
+	v.positive("Transmission.MaxParallelNumber", int64(conf.Transformer.MaxDownloader))
+	v.positive("Transmission.MaxRetryNumber", int64(conf.Transformer.MaxDownloadRetry))
+	v.positive("Transmission.SliceSize", int64(conf.Transformer.TransformPartSize))
+	v.notNegative("Transmission.MaxSliceNumber", int64(conf.Transformer.SingleDownloadMaxWorkers))
+	v.notNegative("Transmission.ShutdownTimeout", int64(conf.Transformer.ShutdownTimeout))
+	v.notNegative("Transmission.MaxBandwidth", conf.Transformer.MaxBandwidth)
+	v.notNegative("Transmission.QueueAging", int64(conf.Transformer.QueueAging))
+	v.notNegative("Transmission.MaxPerDisk", int64(conf.Transformer.MaxPerDisk))
+	v.notNegative("Transmission.Stages.Extract", int64(conf.Transformer.Stages.Extract))
+	v.notNegative("Transmission.Stages.Declare", int64(conf.Transformer.Stages.Declare))
+	v.notNegative("Transmission.Stages.Callback", int64(conf.Transformer.Stages.Callback))
+	v.writableDir("Transmission.WorkDir", conf.Transformer.WorkDir)
+	if _, ok := conf.Transformer.Sources[conf.Transformer.Source]; conf.Transformer.Source != "" && !ok {
+		v.addf("Transmission.Source: %q is not in Transmission.Sources", conf.Transformer.Source)
+	}
+	for i, m := range conf.Transformer.Mirrors {
+		name := fmt.Sprintf("Transmission.Mirrors[%d].URL", i)
+		v.url(name, m.URL, true)
+		if m.URL != "" && !strings.HasSuffix(m.URL, "/") {
+			v.addf("%s: %q should end with /", name, m.URL)
+		}
+	}
+	for name, src := range conf.Transformer.Sources {
+		v.source("Transmission.Sources."+name, src)
+	}
+
+	// Admin
+	if conf.Admin.Address != "" {
+		host, _, err := net.SplitHostPort(conf.Admin.Address)
+		if err != nil {
+			v.addf("Admin.Address: %q should be host:port: %s", conf.Admin.Address, err)
+		} else if !loopback(host) && conf.Admin.Token == "" {
+			v.addf("Admin.Token is required as Admin.Address %q is not a loopback one", conf.Admin.Address)
+		}
+	}
+
+	// Connector
+	if conf.Connector.URL != "" {
+		if u, err := url.Parse(conf.Connector.URL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			v.addf("Connector.URL: %q should be an absolute ws or wss url", conf.Connector.URL)
+		}
+		if len(conf.Connector.ServerKeys) == 0 {
+			v.addf("Connector.ServerKeys is required to verify the platform")
+		}
+		for i, path := range conf.Connector.ServerKeys {
+			if _, err := identity.LoadPublic(util.ExpandHome(path)); err != nil {
+				v.addf("Connector.ServerKeys[%d]: %s", i, err)
+			}
+		}
+	}
+
+	// Miner
+	if !minerIDFormat.MatchString(conf.Miner.ID) {
+		v.addf("Miner.ID: %q should be an id address like f01000 or t01000", conf.Miner.ID)
+	}
+	if !conf.Miner.Discover.Enable {
+		if conf.Miner.StorageID == "" {
+			v.addf("Miner.StorageID is required unless Miner.Discover.Enable")
+		}
+		v.writableDir("Miner.StoreSealedPath", conf.Miner.SealedPath)
+		v.writableDir("Miner.StoreCachePath", conf.Miner.SealedCachePath)
+	}
+	if conf.Miner.Address != "" && !strings.HasPrefix(conf.Miner.Address, "/") {
+		v.url("Miner.Address", conf.Miner.Address, false)
+	}
+	if conf.Miner.APITokenFile != "" {
+		if _, err := os.Stat(util.ExpandHome(conf.Miner.APITokenFile)); err != nil {
+			v.addf("Miner.APITokenFile: %s", err)
+		}
+	}
+
+	// TLS
+	if _, err := buildTLS(conf); err != nil {
+		v.addf("%s", err)
+	}
+
+	// HTTP
+	if conf.HTTP.Proxy != "" {
+		if u, err := url.Parse(conf.HTTP.Proxy); err != nil || u.Host == "" ||
+			(u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			v.addf("HTTP.Proxy: %q should be a http, https or socks5 url", conf.HTTP.Proxy)
+		}
+	}
+	v.notNegative("HTTP.KeepAlive", int64(conf.HTTP.KeepAlive))
+	for name, e := range conf.HTTP.Endpoints {
+		switch name {
+		case EndpointPlatform, EndpointDownload, EndpointBoost, EndpointMiner:
+		default:
+			v.addf("HTTP.Endpoints: unknown endpoint %q, should be platform, download, boost or miner", name)
+		}
+		prefix := "HTTP.Endpoints." + name
+		v.notNegative(prefix+".Timeout", int64(e.Timeout))
+		v.notNegative(prefix+".DialTimeout", int64(e.DialTimeout))
+		v.notNegative(prefix+".TLSHandshakeTimeout", int64(e.TLSHandshakeTimeout))
+		v.notNegative(prefix+".ResponseHeaderTimeout", int64(e.ResponseHeaderTimeout))
+		v.notNegative(prefix+".IdleConnTimeout", int64(e.IdleConnTimeout))
+		v.notNegative(prefix+".MaxIdleConns", int64(e.MaxIdleConns))
+		v.notNegative(prefix+".MaxIdleConnsPerHost", int64(e.MaxIdleConnsPerHost))
+		v.notNegative(prefix+".MaxConnsPerHost", int64(e.MaxConnsPerHost))
+	}
+
+	// Log
+	if conf.Log.Level != "" {
+		if _, err := zerolog.ParseLevel(conf.Log.Level); err != nil {
+			v.addf("Log.Level: %q is not a valid level", conf.Log.Level)
+		}
+	}
+	if conf.Log.Dir != "" {
+		v.writableDir("Log.Dir parent", filepath.Dir(conf.Log.Dir))
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
@@ -1,19 +1,14 @@
-// Note: this package is not used now, just for websocket in future!
 package connector
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/bitrainforest/PandaAgent/pkg/util"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
@@ -39,16 +34,27 @@ type HConn struct {
 	status ConnectStatus // atomic
 	url    string
 	header http.Header
+	// auth authenticates both ends once dialed
+	auth *Handshake
+	// handshake adds the headers of the session to resume, onOpen is called once connected
+	mu        sync.Mutex
+	handshake func(header http.Header)
+	onOpen    func()
 
 	doneCh    chan struct{}
 	closeOnce sync.Once
 }
 
-func NewConn(urlStr string, header http.Header) *HConn {
+func NewConn(urlStr string, header http.Header, dialer *websocket.Dialer, auth *Handshake) *HConn {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
 	c := &HConn{
-		dialer: websocket.DefaultDialer,
+		dialer: dialer,
 		url:    urlStr,
 		header: header.Clone(),
+		auth:   auth,
 		status: ConnectClosed,
 
 		doneCh: make(chan struct{}),
@@ -59,6 +65,20 @@ func NewConn(urlStr string, header http.Header) *HConn {
 	return c
 }
 
+// SetHandshake set the func adds the headers on every connect
+func (c *HConn) SetHandshake(fn func(header http.Header)) {
+	c.mu.Lock()
+	c.handshake = fn
+	c.mu.Unlock()
+}
+
+// SetOnOpen set the func called once the connection is open
+func (c *HConn) SetOnOpen(fn func()) {
+	c.mu.Lock()
+	c.onOpen = fn
+	c.mu.Unlock()
+}
+
 func (c *HConn) SetWriteDeadline(t time.Time) error {
 	if status := getConnStatus(&c.status); status != ConnectOpen {
 		c.reconnect()
@@ -111,22 +131,13 @@ func (c *HConn) Close() {
 }
 
 func (c *HConn) connect() error {
-	// todo: config 配置 cluster, host, uuid
-	cluster := ""
-	host := ""
-	uuid := ""
-
-	timestamp := time.Now().Unix()
-	tmp := []string{"AGENT CONNECTION", cluster, host, uuid, strconv.FormatInt(timestamp, 10)}
-	text := strings.Join(tmp, "\n")
-	sig, err := util.EncryptRSA([]byte(text), "./conf/public.pem")
-	if err != nil {
-		panic(fmt.Errorf("encrypt error: %s", err))
-	}
-	sigBase64 := make([]byte, base64.StdEncoding.EncodedLen(len(sig)))
-	base64.StdEncoding.Encode(sigBase64, sig)
 	header := c.header.Clone()
-	header.Add("X-Luna-Signature", string(sigBase64))
+	c.mu.Lock()
+	handshake, onOpen := c.handshake, c.onOpen
+	c.mu.Unlock()
+	if handshake != nil {
+		handshake(header)
+	}
 	ws, resp, err := c.dialer.Dial(c.url, header)
 	if err != nil {
 		var errMsg []byte
@@ -142,15 +153,30 @@ func (c *HConn) connect() error {
 		log.Error().Err(err).Str("response", string(errMsg)).Msg("websocket dial failed")
 		return err
 	}
+	if c.auth != nil {
+		if err := c.auth.run(ws); err != nil {
+			log.Error().Err(err).Msg("websocket handshake failed")
+			ws.Close()
+			return err
+		}
+	}
 	log.Info().Str("remote conn", ws.RemoteAddr().String()).Msg("websocket connect successfully")
 
 	ws.SetCloseHandler(closeHandler)
 
 	c.ws = ws
 	setConnStatus(&c.status, ConnectOpen)
+	if onOpen != nil {
+		onOpen()
+	}
 	return nil
 }
 
+// Reconnect close the connection, it is connected again later
+func (c *HConn) Reconnect() {
+	c.reconnect()
+}
+
 func (c *HConn) reconnect() {
 	if getConnStatus(&c.status) != ConnectOpen {
 		return
@@ -0,0 +1,206 @@
+package connector
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the handshake messages, the platform sends the challenge once the websocket is open,
+	// the agent answers with auth, and the platform proves itself with welcome
+	ChallengeType MessageType = "challenge"
+	AuthType      MessageType = "auth"
+	WelcomeType   MessageType = "welcome"
+
+	handshakeTimeout = 10 * time.Second
+	// maxClockSkew is the difference allowed between the challenge timestamp and the local clock
+	maxClockSkew = 5 * time.Minute
+)
+
+type ChallengePayload struct {
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type AuthPayload struct {
+	AgentID   string `json:"agentId,omitempty"`
+	KeyID     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"publicKey"`
+	Host      string `json:"host,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	// Nonce is the challenge of the agent the platform signs in welcome
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+	// PreviousKeyID and PreviousSignature vouch for a rotated key by the key before
+	PreviousKeyID     string `json:"previousKeyId,omitempty"`
+	PreviousSignature string `json:"previousSignature,omitempty"`
+}
+
+type WelcomePayload struct {
+	KeyID     string `json:"keyId"`
+	Signature string `json:"signature"`
+}
+
+// Handshake authenticates the agent and the platform to each other once the websocket is open.
+// The agent signs the platform nonce, and the platform signs the agent nonce with one of ServerKeys.
+type Handshake struct {
+	Key *identity.Key
+	// Previous is the key before rotation, it vouches for Key until the platform accepts Key
+	Previous *identity.Key
+	// Rotated is called once the platform accepts the rotated key
+	Rotated    func()
+	ServerKeys []crypto.PublicKey
+	Host       string
+	AgentID    string
+}
+
+// AgentText is signed by the agent key
+func AgentText(serverNonce string, timestamp int64, agentNonce, keyID string) []byte {
+	return []byte(strings.Join([]string{"PANDA AGENT AUTH", serverNonce, strconv.FormatInt(timestamp, 10), agentNonce, keyID}, "\n"))
+}
+
+// RotateText is signed by the previous agent key
+func RotateText(serverNonce, keyID string) []byte {
+	return []byte(strings.Join([]string{"PANDA AGENT ROTATE", serverNonce, keyID}, "\n"))
+}
+
+// ServerText is signed by the platform key
+func ServerText(agentNonce, serverNonce, keyID string) []byte {
+	return []byte(strings.Join([]string{"PANDA SERVER AUTH", agentNonce, serverNonce, keyID}, "\n"))
+}
+
+func (h *Handshake) run(ws *websocket.Conn) error {
+	ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	ws.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+	defer ws.SetWriteDeadline(time.Time{})
+
+	var challenge ChallengePayload
+	if err := readPayload(ws, ChallengeType, &challenge); err != nil {
+		return err
+	}
+	if skew := time.Since(time.Unix(challenge.Timestamp, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("challenge timestamp is %s off the local clock", skew)
+	}
+	if challenge.Nonce == "" {
+		return fmt.Errorf("empty challenge nonce")
+	}
+
+	pub, err := h.Key.PublicPEM()
+	if err != nil {
+		return err
+	}
+
+	auth := AuthPayload{
+		AgentID:   h.AgentID,
+		KeyID:     h.Key.ID(),
+		Algorithm: h.Key.Algorithm(),
+		PublicKey: string(pub),
+		Host:      h.Host,
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce(),
+	}
+	sig, err := h.Key.Sign(AgentText(challenge.Nonce, auth.Timestamp, auth.Nonce, auth.KeyID))
+	if err != nil {
+		return err
+	}
+	auth.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	if h.Previous != nil {
+		sig, err := h.Previous.Sign(RotateText(challenge.Nonce, auth.KeyID))
+		if err != nil {
+			return err
+		}
+		auth.PreviousKeyID = h.Previous.ID()
+		auth.PreviousSignature = base64.StdEncoding.EncodeToString(sig)
+	}
+
+	if err := writePayload(ws, AuthType, auth); err != nil {
+		return err
+	}
+
+	var welcome WelcomePayload
+	if err := readPayload(ws, WelcomeType, &welcome); err != nil {
+		return err
+	}
+	if err := h.verifyServer(ServerText(auth.Nonce, challenge.Nonce, auth.KeyID), welcome); err != nil {
+		return err
+	}
+
+	if h.Previous != nil {
+		log.Info().Str("key", auth.KeyID).Str("previous", auth.PreviousKeyID).Msg("rotated key accepted by the platform")
+		h.Previous = nil
+		if h.Rotated != nil {
+			h.Rotated()
+		}
+	}
+
+	return nil
+}
+
+// verifyServer check the welcome is signed by one of the platform keys
+func (h *Handshake) verifyServer(text []byte, welcome WelcomePayload) error {
+	sig, err := base64.StdEncoding.DecodeString(welcome.Signature)
+	if err != nil {
+		return fmt.Errorf("bad welcome signature: %s", err)
+	}
+
+	for _, k := range h.ServerKeys {
+		if welcome.KeyID != "" && welcome.KeyID != identity.Fingerprint(k) {
+			continue
+		}
+		if identity.Verify(k, text, sig) == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("welcome is not signed by a platform key (key id: %q)", welcome.KeyID)
+}
+
+func readPayload(ws *websocket.Conn, typ MessageType, v interface{}) error {
+	_, b, err := ws.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read %s err: %s", typ, err)
+	}
+
+	msg, err := MessageBytes(b).Deserialize()
+	if err != nil {
+		return fmt.Errorf("read %s err: %s", typ, err)
+	}
+	if msg.Type != typ {
+		return fmt.Errorf("expect %s message, got %s", typ, msg.Type)
+	}
+
+	return json.Unmarshal(msg.Payload, v)
+}
+
+func writePayload(ws *websocket.Conn, typ MessageType, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewMessage(typ, "", b).Serialize()
+	if err != nil {
+		return err
+	}
+
+	return ws.WriteMessage(websocket.BinaryMessage, s)
+}
+
+func nonce() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,229 @@
+package connector
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"github.com/gorilla/websocket"
+)
+
+// platform stands in for the platform side of the handshake, welcome is signed over
+// the text returned by sign, and the auth it receives is checked by verify
+type platform struct {
+	key    *identity.Key
+	sign   func(serverNonce string, auth AuthPayload) []byte
+	verify func(serverNonce string, auth AuthPayload) error
+	errs   chan error
+}
+
+func (p *platform) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		p.errs <- err
+		return
+	}
+	defer ws.Close()
+
+	p.errs <- p.serve(ws)
+}
+
+func (p *platform) serve(ws *websocket.Conn) error {
+	challenge := ChallengePayload{Nonce: nonce(), Timestamp: time.Now().Unix()}
+	if err := writePayload(ws, ChallengeType, challenge); err != nil {
+		return err
+	}
+
+	var auth AuthPayload
+	if err := readPayload(ws, AuthType, &auth); err != nil {
+		return err
+	}
+	pub, err := identity.ParsePublic([]byte(auth.PublicKey))
+	if err != nil {
+		return err
+	}
+	if identity.Fingerprint(pub) != auth.KeyID {
+		return fmt.Errorf("key id %s is not the public key", auth.KeyID)
+	}
+	if err := verifySig(pub, AgentText(challenge.Nonce, auth.Timestamp, auth.Nonce, auth.KeyID), auth.Signature); err != nil {
+		return fmt.Errorf("agent signature: %s", err)
+	}
+	if p.verify != nil {
+		if err := p.verify(challenge.Nonce, auth); err != nil {
+			return err
+		}
+	}
+
+	text := ServerText(auth.Nonce, challenge.Nonce, auth.KeyID)
+	if p.sign != nil {
+		text = p.sign(challenge.Nonce, auth)
+	}
+	sig, err := p.key.Sign(text)
+	if err != nil {
+		return err
+	}
+
+	return writePayload(ws, WelcomeType, WelcomePayload{KeyID: p.key.ID(), Signature: base64.StdEncoding.EncodeToString(sig)})
+}
+
+func verifySig(pub crypto.PublicKey, text []byte, s string) error {
+	sig, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return identity.Verify(pub, text, sig)
+}
+
+func newKey(t *testing.T) *identity.Key {
+	k, err := identity.Generate(identity.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+// handshake run h against p, the errors of both sides are returned
+func handshake(t *testing.T, p *platform, h *Handshake) (agentErr, platformErr error) {
+	p.errs = make(chan error, 1)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentErr = h.run(ws)
+	ws.Close()
+
+	return agentErr, <-p.errs
+}
+
+func TestHandshake(t *testing.T) {
+	server := newKey(t)
+	h := &Handshake{Key: newKey(t), ServerKeys: []crypto.PublicKey{server.Public()}, AgentID: "agent"}
+
+	agentErr, platformErr := handshake(t, &platform{key: server}, h)
+	if platformErr != nil {
+		t.Fatalf("platform: %s", platformErr)
+	}
+	if agentErr != nil {
+		t.Fatalf("agent: %s", agentErr)
+	}
+}
+
+func TestHandshakeBadWelcome(t *testing.T) {
+	server := newKey(t)
+
+	for _, c := range []struct {
+		name string
+		key  *identity.Key
+		sign func(serverNonce string, auth AuthPayload) []byte
+	}{
+		{"wrong agent nonce", server, func(serverNonce string, auth AuthPayload) []byte {
+			return ServerText(nonce(), serverNonce, auth.KeyID)
+		}},
+		{"wrong server nonce", server, func(serverNonce string, auth AuthPayload) []byte {
+			return ServerText(auth.Nonce, nonce(), auth.KeyID)
+		}},
+		{"wrong key id", server, func(serverNonce string, auth AuthPayload) []byte {
+			return ServerText(auth.Nonce, serverNonce, "other")
+		}},
+		{"unknown platform key", newKey(t), nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := &Handshake{Key: newKey(t), ServerKeys: []crypto.PublicKey{server.Public()}}
+			agentErr, platformErr := handshake(t, &platform{key: c.key, sign: c.sign}, h)
+			if platformErr != nil {
+				t.Fatalf("platform: %s", platformErr)
+			}
+			if agentErr == nil {
+				t.Fatal("the welcome should be rejected")
+			}
+		})
+	}
+}
+
+func TestHandshakeRotate(t *testing.T) {
+	server := newKey(t)
+	path := filepath.Join(t.TempDir(), "agent.key")
+	if _, err := identity.LoadOrCreate(path); err != nil {
+		t.Fatal(err)
+	}
+	key, err := identity.Rotate(path, identity.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := identity.Previous(path)
+	if err != nil || previous == nil {
+		t.Fatalf("previous key: %v, %v", previous, err)
+	}
+
+	rotated := 0
+	h := &Handshake{
+		Key:      key,
+		Previous: previous,
+		Rotated: func() {
+			rotated++
+			os.Remove(identity.PreviousPath(path))
+		},
+		ServerKeys: []crypto.PublicKey{server.Public()},
+	}
+	vouched := func(serverNonce string, auth AuthPayload) error {
+		if auth.PreviousKeyID != previous.ID() {
+			return fmt.Errorf("previous key id %q, want %q", auth.PreviousKeyID, previous.ID())
+		}
+		return verifySig(previous.Public(), RotateText(serverNonce, auth.KeyID), auth.PreviousSignature)
+	}
+
+	// the platform does not accept it, the old key is kept to vouch again
+	agentErr, platformErr := handshake(t, &platform{key: server, verify: vouched, sign: func(string, AuthPayload) []byte {
+		return []byte("rejected")
+	}}, h)
+	if platformErr != nil {
+		t.Fatalf("platform: %s", platformErr)
+	}
+	if agentErr == nil {
+		t.Fatal("the welcome should be rejected")
+	}
+	if rotated != 0 || h.Previous == nil {
+		t.Fatal("the rotation is finished before the platform accepts it")
+	}
+	if _, err := os.Stat(identity.PreviousPath(path)); err != nil {
+		t.Fatalf("the old key is removed: %s", err)
+	}
+
+	agentErr, platformErr = handshake(t, &platform{key: server, verify: vouched}, h)
+	if platformErr != nil {
+		t.Fatalf("platform: %s", platformErr)
+	}
+	if agentErr != nil {
+		t.Fatalf("agent: %s", agentErr)
+	}
+	if rotated != 1 || h.Previous != nil {
+		t.Fatalf("rotated %d times, previous %v", rotated, h.Previous)
+	}
+	if _, err := os.Stat(identity.PreviousPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("the old key is kept: %v", err)
+	}
+
+	// the next handshake does not vouch any more
+	agentErr, platformErr = handshake(t, &platform{key: server, verify: func(_ string, auth AuthPayload) error {
+		if auth.PreviousKeyID != "" || auth.PreviousSignature != "" {
+			return fmt.Errorf("vouched again by %s", auth.PreviousKeyID)
+		}
+		return nil
+	}}, h)
+	if platformErr != nil || agentErr != nil {
+		t.Fatalf("platform: %v, agent: %v", platformErr, agentErr)
+	}
+}
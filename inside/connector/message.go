@@ -1,7 +1,8 @@
-// Note: this package is not used now, just for websocket in future!
 package connector
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -15,6 +16,15 @@ const (
 	FileType    MessageType = "file"
 	CommandType MessageType = "command"
 	JsonType    MessageType = "json"
+
+	// AssignType pushes the sectors to download, the payload is like the list of Platform.QueryURL
+	AssignType MessageType = "assign"
+	// CancelType withdraws the sectors, the payload is CancelPayload
+	CancelType MessageType = "cancel"
+	// ConfigType updates the configuration, the payload is ConfigPayload
+	ConfigType MessageType = "config"
+	// AckType only carries Ack, it is not acknowledged itself
+	AckType MessageType = "ack"
 )
 
 type Module string
@@ -27,15 +37,22 @@ const (
 )
 
 type Message struct {
+	// ID identifies the message, a replayed one keeps it
+	ID        string `json:",omitempty"`
 	Type      MessageType
 	Timestamp string
 	Module    Module
 	Session   string
 	Payload   json.RawMessage
+	// Seq numbers the messages of a connection session from 1 in each direction, 0 is not sequenced
+	Seq uint64 `json:",omitempty"`
+	// Ack is the last Seq of the peer processed, the ones before it are acknowledged as well
+	Ack uint64 `json:",omitempty"`
 }
 
 func NewMessage(typ MessageType, mod Module, data []byte) *Message {
 	m := &Message{
+		ID:        NewID(),
 		Type:      typ,
 		Timestamp: time.Now().Format(util.TimeFormat),
 		Module:    mod,
@@ -45,6 +62,52 @@ func NewMessage(typ MessageType, mod Module, data []byte) *Message {
 	return m
 }
 
+type CancelPayload struct {
+	SectorIDs []string `json:"sectorIds"`
+}
+
+type ConfigPayload struct {
+	// Sets are key=value like the --set flags
+	Sets []string `json:"sets"`
+}
+
+// NewAck build the message acknowledges the peer messages up to seq
+func NewAck(seq uint64) *Message {
+	return &Message{
+		Type:      AckType,
+		Timestamp: time.Now().Format(util.TimeFormat),
+		Ack:       seq,
+	}
+}
+
+// NewID return a random id of a message or a session
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// FetchPayload starts the download of a sector
+type FetchPayload struct {
+	SectorID string `json:"sectorId"`
+	Source   string `json:"source,omitempty"`
+	Urgent   bool   `json:"urgent,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// CopyPayload moves a sector between the local storage paths of the miner
+type CopyPayload struct {
+	SectorID string `json:"sectorId"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// ExecPayload runs a program of the shell module or a script of the python module
+type ExecPayload struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
 type MessageBytes []byte
 
 func (mb MessageBytes) Deserialize() (Message, error) {
@@ -53,6 +116,18 @@ func (mb MessageBytes) Deserialize() (Message, error) {
 	return m, err
 }
 
+// Seq return the Seq of a message can not be deserialized, 0 if not found
+func (mb MessageBytes) Seq() uint64 {
+	var m struct {
+		Seq uint64
+	}
+	if err := json.Unmarshal([]byte(mb), &m); err != nil {
+		return 0
+	}
+
+	return m.Seq
+}
+
 func (m *Message) Serialize() ([]byte, error) {
 	return json.Marshal(*m)
 }
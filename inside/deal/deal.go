@@ -3,14 +3,15 @@ package deal
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/bitrainforest/PandaAgent/inside/boost"
 	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/httpclient"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,54 +22,64 @@ type DealTransform struct {
 	doneCtx          context.Context
 	cancle           context.CancelFunc
 	token            string
+	agentID          string
 	boostCli         *boost.BoostCli
 	ch               chan []byte
 	buffer           [][]byte
 	maxBuffer        int
+	// done is closed after the pending deals are flushed
+	done chan struct{}
+	// lock the url and token which can be reloaded
+	mu     sync.Mutex
+	ticker *time.Ticker
 }
 
-func InitDealTransform(conf config.Config, parentCtx context.Context) *DealTransform {
-	var dt DealTransform
-	dt.cli = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			TLSHandshakeTimeout:   5 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			MaxIdleConns:          50,
-			MaxIdleConnsPerHost:   1,
-			MaxConnsPerHost:       10,
-			IdleConnTimeout:       10 * time.Second,
-		},
-		Timeout: time.Duration(conf.GH.Timeout) * time.Second,
+func InitDealTransform(conf config.Config, parentCtx context.Context) (*DealTransform, error) {
+	cli, err := httpclient.New(conf, config.EndpointPlatform)
+	if err != nil {
+		return nil, fmt.Errorf("build platform client err: %s", err)
+	}
+	boostCli, err := httpclient.New(conf, config.EndpointBoost)
+	if err != nil {
+		return nil, fmt.Errorf("build boost client err: %s", err)
 	}
 
+	var dt DealTransform
+	dt.cli = cli
+
 	ctx, cancle := context.WithCancel(parentCtx)
 	dt.cancle = cancle
 	dt.doneCtx = ctx
-	dt.token = conf.GH.Token
+	dt.token = conf.GH.Token.Value()
+	dt.agentID = conf.AgentID
 	dt.frequency = conf.GH.DealFrequency
 	dt.dealTransformURL = conf.GH.DealURL
 	//todo: 10 need configurable
 	dt.ch = make(chan []byte, 10)
-	dt.boostCli = boost.InitBoostCli(conf.Boost.RPCURL, conf.Boost.GraphQlURL, conf.Boost.APIToken, dt.ch)
+	dt.boostCli = boost.InitBoostCli(conf.Boost.RPCURL, conf.Boost.GraphQlURL, conf.Boost.APIToken.Value(),
+		boostCli, dt.ch)
 	dt.buffer = make([][]byte, 0, 10)
 	dt.maxBuffer = 10
+	dt.done = make(chan struct{})
 
-	return &dt
+	return &dt, nil
 }
 
 func (dt *DealTransform) Run() {
-	go dt.boostCli.Start()
+	go dt.boostCli.Start(dt.doneCtx)
 	go func() {
-		ticker := time.Tick(dt.frequency)
+		defer close(dt.done)
+		dt.mu.Lock()
+		dt.ticker = time.NewTicker(dt.frequency)
+		dt.mu.Unlock()
+		defer dt.ticker.Stop()
 		for {
 			select {
 			case <-dt.doneCtx.Done():
+				dt.flush()
 				log.Info().Msgf("[DealTransform] Stop.")
 				return
-			case <-ticker:
+			case <-dt.ticker.C:
 				if len(dt.buffer) > 0 {
 					log.Info().Msgf("[DealTransform] do Transform.")
 					dt.Transform()
@@ -92,6 +103,53 @@ func (dt *DealTransform) Run() {
 	}()
 }
 
+// Reload apply the frequency, url and token
+func (dt *DealTransform) Reload(conf config.Config) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.frequency != conf.GH.DealFrequency && dt.ticker != nil {
+		dt.ticker.Reset(conf.GH.DealFrequency)
+	}
+	dt.frequency = conf.GH.DealFrequency
+	dt.dealTransformURL = conf.GH.DealURL
+	dt.token = conf.GH.Token.Value()
+	log.Info().Msgf("[DealTransform] reload, frequency: %s", dt.frequency)
+}
+
+// Stop stop querying boost and wait the pending deals to be uploaded until ctx is done
+func (dt *DealTransform) Stop(ctx context.Context) {
+	dt.cancle()
+	select {
+	case <-dt.done:
+	case <-ctx.Done():
+		log.Warn().Msgf("[DealTransform] flush timeout, the deals not uploaded yet are dropped")
+	}
+}
+
+// flush upload the buffered deals and the deals left in channel
+func (dt *DealTransform) flush() {
+	for {
+		select {
+		case d := <-dt.ch:
+			dt.buffer = append(dt.buffer, d)
+			if len(dt.buffer) < dt.maxBuffer {
+				continue
+			}
+		default:
+		}
+
+		if len(dt.buffer) == 0 {
+			return
+		}
+
+		log.Info().Msgf("[DealTransform] flush %d deals.", len(dt.buffer))
+		if err := dt.Transform(); err != nil {
+			log.Error().Msgf("[DealTransform] flush err: %s", err)
+		}
+		dt.buffer = dt.buffer[:0]
+	}
+}
+
 type Deal struct {
 	UUID                string `json:"uuid,omitempty"`
 	PieceID             string `json:"pieceCID,omitempty"`
@@ -108,6 +166,7 @@ type Deal struct {
 
 type DealContent struct {
 	Total   int      `json:"total,omitempty"`
+	AgentID string   `json:"agentId,omitempty"`
 	Extra   string   `json:"extra,omitempty"`
 	Content []string `json:"content,omitempty"`
 }
@@ -116,6 +175,7 @@ func (dt *DealTransform) Transform() error {
 	var c DealContent
 	c.Content = make([]string, 0, len(dt.buffer))
 	c.Total = len(dt.buffer)
+	c.AgentID = dt.agentID
 	for _, d := range dt.buffer {
 		/*
 			sigName, _ := d.ClientSignature.Name()
@@ -141,13 +201,17 @@ func (dt *DealTransform) Transform() error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", dt.dealTransformURL, bytes.NewReader(content))
+	dt.mu.Lock()
+	dealTransformURL, token := dt.dealTransformURL, dt.token
+	dt.mu.Unlock()
+
+	req, err := http.NewRequest("POST", dealTransformURL, bytes.NewReader(content))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("minerToken", dt.token)
+	req.Header.Set("minerToken", token)
 
 	resp, err := dt.cli.Do(req)
 	if err != nil {
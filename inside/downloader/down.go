@@ -4,7 +4,6 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,9 +14,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/httpclient"
 	"github.com/bitrainforest/PandaAgent/inside/minerclient"
 	"github.com/bitrainforest/PandaAgent/inside/types"
 	"github.com/patrickmn/go-cache"
@@ -35,6 +36,11 @@ const (
 	StatusCodeFailed         = 20000
 )
 
+const (
+	// DefaultMaxWorkers is the download goroutines of one file if MaxSliceNumber is not set
+	DefaultMaxWorkers = 5
+)
+
 var (
 	ErrRetryExceed    = errors.New("retry exceed")
 	globalTransformer *Transformer
@@ -55,29 +61,81 @@ type Transformer struct {
 	CacheDir                 string
 	SealedDir                string
 	minerID                  string
-	downloadURL              string
 	MaxDownloader            int
 	MaxDownloadRetry         int
 	singleDownloadMaxWorkers int
 	transformPartSize        int
-	// ch is used for control the number of downloader
-	ch          chan types.Sector
+	// queue is the sectors waiting to download
+	queue *Queue
+	// workers is the number of sector workers, resized to MaxDownloader.
+	// poolCtx is canceled to wake up the idle workers when resized.
+	workers    int
+	poolCtx    context.Context
+	poolCancel context.CancelFunc
+	// fetchWG waits the fetch workers, the stages after fetch are closed then
+	fetchWG sync.WaitGroup
+	stages  []*stage
+	// disks limits the files downloading to one disk
+	disks       *diskLimiter
 	ctx         context.Context
 	cancel      context.CancelFunc
 	callBackURL string
 	token       string
+	// agentID is sent with every callback
+	agentID     string
 	workDir     string
 	processingM map[int]bool
 	c           *cache.Cache
+	// stale declarations to drop after the sector is declared again
+	stale map[int][]staleDecl
+	// buf is the queue from engine, drained when stop
+	buf      chan types.Sector
+	stopping chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	limiter  *Limiter
+	// downloadCli is shared by the downloaders
+	downloadCli *http.Client
+	// sources are the configured ones, defaultSource is used if the sector names none
+	sources       map[string]Source
+	defaultSource string
+	// mirrors serve the platform files, it is used if no source is named
+	mirrors *mirrorSource
+	// progress is reported by the heartbeat
+	progress *progress
+	// finished are the sectors done and still listed by the platform, recalled are the ones
+	// of them the callback is sent again
+	finished map[int]bool
+	recalled map[int]bool
+	// missing counts the polls in a row a processing sector is not listed
+	missing map[int]int
+	// withdrawn are the in-flight sectors the platform no longer lists, they are dropped by the stage holding them
+	withdrawn map[int]bool
+	inflight  map[int]inflight
+	// manual are the processing sectors requested by command, failed are the ones given up
+	manual map[int]bool
+	failed map[int]bool
 }
 
-func InitTransformer(conf config.Config, ctx context.Context) *Transformer {
+func InitTransformer(conf config.Config, ctx context.Context) (*Transformer, error) {
+	minerCli, err := minerclient.NewMinerCli(conf)
+	if err != nil {
+		return nil, fmt.Errorf("resolve miner api err: %s", err)
+	}
+	cli, err := httpclient.New(conf, config.EndpointPlatform)
+	if err != nil {
+		return nil, fmt.Errorf("build platform client err: %s", err)
+	}
+	downloadCli, err := httpclient.New(conf, config.EndpointDownload)
+	if err != nil {
+		return nil, fmt.Errorf("build download client err: %s", err)
+	}
+
 	//todo: add sync.Once
 	t := &Transformer{
-		cli: &http.Client{
-			Timeout: time.Duration(conf.GH.Timeout) * time.Second,
-		},
-		minerCli:                 minerclient.InitMinerCli(conf),
+		cli:                      cli,
+		downloadCli:              downloadCli,
+		minerCli:                 minerCli,
 		CacheDir:                 conf.Miner.SealedCachePath,
 		SealedDir:                conf.Miner.SealedPath,
 		MaxDownloader:            conf.Transformer.MaxDownloader,
@@ -86,28 +144,94 @@ func InitTransformer(conf config.Config, ctx context.Context) *Transformer {
 		singleDownloadMaxWorkers: conf.Transformer.SingleDownloadMaxWorkers,
 		callBackURL:              conf.GH.CallBack,
 		minerID:                  conf.Miner.ID,
-		downloadURL:              conf.GH.DownloadURL,
-		token:                    conf.GH.Token,
+		agentID:                  conf.AgentID,
+		token:                    conf.GH.Token.Value(),
 		workDir:                  conf.Transformer.WorkDir,
 		processingM:              make(map[int]bool),
+		stale:                    make(map[int][]staleDecl),
+		stopping:                 make(chan struct{}),
 		c:                        cache.New(5*time.Minute, 10*time.Minute),
+		limiter:                  NewLimiter(conf.Transformer.MaxBandwidth),
+		sources:                  make(map[string]Source),
+		defaultSource:            conf.Transformer.Source,
+		progress:                 newProgress(),
+		finished:                 make(map[int]bool),
+		recalled:                 make(map[int]bool),
+		missing:                  make(map[int]int),
+		withdrawn:                make(map[int]bool),
+		inflight:                 make(map[int]inflight),
+		manual:                   make(map[int]bool),
+		failed:                   make(map[int]bool),
+	}
+	t.mirrors = newMirrorSource(t.downloadCli)
+	t.mirrors.Set(conf.GH.DownloadURL, conf.Transformer.Mirrors, conf.GH.Token.Value())
+	for name, sc := range conf.Transformer.Sources {
+		src, err := NewSource(sc, t.downloadCli)
+		if err != nil {
+			log.Error().Msgf("[Transformer] source %s err: %s", name, err)
+			continue
+		}
+		t.sources[name] = src
+	}
+	t.queue = NewQueue(conf.Transformer.QueueAging)
+	t.disks = newDiskLimiter(conf.Transformer.MaxPerDisk)
+	t.stages = []*stage{
+		t.newStage(StageExtract, conf.Transformer.Stages.Extract, types.NeedDownloadCache, t.extract),
+		t.newStage(StageDeclare, conf.Transformer.Stages.Declare, types.NeedDeclare, t.declare),
+		t.newStage(StageCallback, conf.Transformer.Stages.Callback, types.NeedCallback, t.callback),
 	}
-	t.ch = make(chan types.Sector, t.MaxDownloader)
 	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.poolCtx, t.poolCancel = context.WithCancel(t.ctx)
 
-	log.Info().Msgf("[Transformer] init: %+v", t)
+	log.Info().Msgf("[Transformer] init: miner: %s, sealed: %s, cache: %s, workers: %d, retry: %d, part size: %d",
+		t.minerID, t.SealedDir, t.CacheDir, t.MaxDownloader, t.MaxDownloadRetry, t.transformPartSize)
 	globalTransformer = t
-	return t
+	return t, nil
+}
+
+// Reload apply the reloadable configuration, the in-flight sectors keep the old one.
+func (t *Transformer) Reload(conf config.Config) {
+	t.Lock()
+	t.MaxDownloader = conf.Transformer.MaxDownloader
+	t.MaxDownloadRetry = conf.Transformer.MaxDownloadRetry
+	t.transformPartSize = conf.Transformer.TransformPartSize
+	t.singleDownloadMaxWorkers = conf.Transformer.SingleDownloadMaxWorkers
+	t.callBackURL = conf.GH.CallBack
+	t.token = conf.GH.Token.Value()
+	t.defaultSource = conf.Transformer.Source
+	t.Unlock()
+
+	// the in-flight sectors use the new mirrors for the parts left
+	t.mirrors.Set(conf.GH.DownloadURL, conf.Transformer.Mirrors, conf.GH.Token.Value())
+
+	t.limiter.SetLimit(conf.Transformer.MaxBandwidth)
+	t.queue.SetAging(conf.Transformer.QueueAging)
+	t.disks.SetLimit(conf.Transformer.MaxPerDisk)
+	t.Lock()
+	running := t.buf != nil
+	t.Unlock()
+	if running {
+		t.startWorkers()
+	}
+	log.Info().Msgf("[Transformer] reload, retry: %d, part size: %d, workers: %d, bandwidth: %d",
+		conf.Transformer.MaxDownloadRetry, conf.Transformer.TransformPartSize, conf.Transformer.SingleDownloadMaxWorkers, conf.Transformer.MaxBandwidth)
 }
 
-// not very precise
+// Downloading return true if any sector is waiting
 func (t *Transformer) Downloading() bool {
-	return len(t.ch) > 0
+	return t.queue.Len() > 0
 }
 
 func (t *Transformer) UnProcessing(sectorID int) {
 	t.Lock()
 	delete(t.processingM, sectorID)
+	delete(t.withdrawn, sectorID)
+	delete(t.missing, sectorID)
+	delete(t.manual, sectorID)
+	if f, ok := t.inflight[sectorID]; ok {
+		f.cancel()
+		delete(t.inflight, sectorID)
+	}
 	t.Unlock()
 }
 
@@ -144,191 +268,226 @@ func (t *Transformer) Skip(s types.Sector) bool {
 
 // todo: run code need improve
 func (t *Transformer) Run(buf chan types.Sector) {
+	t.Lock()
+	t.buf = buf
+	t.Unlock()
+	for _, s := range t.restore() {
+		t.enqueue(s)
+	}
+
+	t.wg.Add(1)
 	go func() {
+		defer t.wg.Done()
+		// move the sectors into the priority queue as soon as they come
 		for {
 			select {
 			case s, ok := <-buf:
 				if !ok {
 					log.Warn().Msgf("[Transformer] channel is cloesed, exit")
-					break
+					return
 				}
 
-				t.Lock()
-				t.processingM[s.ID] = true
-				t.Unlock()
-
-				log.Debug().Msgf("[Transformer] try download s: %+v", s)
-				t.ch <- s
+				t.enqueue(s)
+			case <-t.stopping:
+				return
 			case <-t.ctx.Done():
 				return
 			}
 		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case s, ok := <-t.ch:
-				if !ok {
-					log.Warn().Msgf("[Transformer] channel is cloesed, exit")
-					break
-				}
+	t.wg.Add(1)
+	go t.sampleStats()
 
-				log.Debug().Msgf("[Transformer] start download s: %+v", s)
-				s.Try += 1
-				if s.Try > t.MaxDownloadRetry {
-					log.Info().Msgf("[Transformer] miner: %s, sector: %d retry too much, do failed callback", t.minerID, s.ID)
-
-					/*
-					   if err := t.CallBack(DownloadCallBackContent{
-					     Action:     ActionDownload,
-					     Status:     StatusDownloadFailed,
-					     StatusCode: StatusCodeFailed,
-					     SectorIDs:  []string{strconv.Itoa(s.ID)},
-					     MinerID:    t.minerID,
-					     ErrMsg:     ErrRetryExceed.Error(),
-					   }); err != nil {
-					     log.Error().Msgf("[Transformer] callback err: %s", err)
-					   }
-					*/
-
-					t.UnProcessing(s.ID)
-					continue
-				}
-				var (
-					target string
-					srcURL string
-				)
-
-				if s.NeedDownloadSealed() {
-					minerID := t.minerID
-					// the minerID may be t10000, f10000....., but we store it only named t10000
-					if !strings.HasPrefix(minerID, "t") {
-						minerID = "t" + minerID[1:]
-					}
-					target = fmt.Sprintf("%s/s-%s-%d", t.SealedDir, minerID, s.ID)
-					srcURL = fmt.Sprintf("%ssealedsectors/%s/%d", t.downloadURL, t.minerID, s.ID)
-					if _, err := os.Stat(target); err == nil {
-						// remove if exist
-						log.Info().Msgf("[Transformer] target: %s exist, remove", target)
-						os.Remove(target)
-					}
+	t.startWorkers()
+	t.startStages()
+}
 
-					log.Debug().Msgf("[Transformer] start download target: %s, src: %s", target, srcURL)
-					d := InitDownloader(srcURL, target, "", t.token, t.minerID, t.transformPartSize, t.singleDownloadMaxWorkers, s.ID, false, true, t.ctx)
-					if err := d.DownloadFile(); err != nil {
-						log.Error().Msgf("[Transformer] Download sealed file failed, sector's metainfo: %+v, err: %s, retry", s, err)
-						// need retry
-						go func() {
-							s.Status = types.NeedFour
-							t.ch <- s
-						}()
-
-						continue
-					}
+// enqueue put the sector into the queue, the waiting sectors are persisted when the transformer stops.
+func (t *Transformer) enqueue(s types.Sector) {
+	t.Lock()
+	t.processingM[s.ID] = true
+	delete(t.failed, s.ID)
+	if s.Manual {
+		t.manual[s.ID] = true
+	}
+	t.Unlock()
 
-					log.Info().Msgf("[Transformer] miner: %s, sector: %d download sealed success", t.minerID, s.ID)
-				}
+	log.Debug().Msgf("[Transformer] try download s: %+v", s)
+	t.queue.Push(s)
+}
 
-				if s.NeedDownloadCache() {
-					target = fmt.Sprintf("%s/s-%s-%d", t.workDir, t.minerID, s.ID)
-					// we now support 32GB sector's download
-					srcURL = fmt.Sprintf("%ssectortree/%s/32/%d", t.downloadURL, t.minerID, s.ID)
+// retry put the sector back to the queue from status
+func (t *Transformer) retry(s types.Sector, status types.SectorDownloadStatus) {
+	s.Rewind(status)
+	if t.isWithdrawn(s.ID) {
+		t.drop(s)
+		return
+	}
 
-					if _, err := os.Stat(target); err == nil {
-						// remove if exist
-						log.Info().Msgf("[Transformer] target: %s exist, remove", target)
-						os.Remove(target)
-					}
+	t.queue.Push(s)
+}
 
-					log.Debug().Msgf("[Transformer] start download target: %s, src: %s", target, srcURL)
-					d := InitDownloader(srcURL, target, t.CacheDir, t.token, t.minerID, t.transformPartSize, t.singleDownloadMaxWorkers, s.ID, true, false, t.ctx)
-					if err := d.DownloadFile(); err != nil {
-						log.Error().Msgf("[Transformer] DownloadFile cache failed, sector's metainfo: %+v, err: %s, retry", s, err)
-						// need retry
-						go func() {
-							s.Status = types.NeedThree
-							t.ch <- s
-						}()
-
-						continue
-					}
+// Bump set the priority of a waiting sector
+func (t *Transformer) Bump(sectorID, priority int) error {
+	if !t.queue.Bump(sectorID, priority) {
+		return fmt.Errorf("sector %d is not waiting in the queue", sectorID)
+	}
 
-					log.Info().Msgf("[Transformer] miner: %s, sector: %d download cache success", t.minerID, s.ID)
-				}
+	log.Info().Msgf("[Transformer] sector: %d priority bumped to %d", sectorID, priority)
+	return nil
+}
 
-				/*
-					if err := t.CallBack(DownloadCallBackContent{
-						Action:     ActionDownload,
-						Status:     StatusDownloadSuccessful,
-						StatusCode: StatusCodeOK,
-						SectorIDs:  []string{strconv.Itoa(s.ID)},
-						MinerID:    t.minerID,
-					}); err != nil {
-						log.Error().Msgf("[Transformer] callback err: %s", err)
-					}
-				*/
-				if s.NeedDeclare() {
-					if err := t.DeclareSector(s.ID); err != nil {
-						// if declare failed, we need user declare sector in current implement.
-						log.Error().Msgf("[Transformer] miner: %s DeclareSector: %d err: %s, retry", t.minerID, s.ID, err)
-						/*
-							if err := t.CallBack(DownloadCallBackContent{
-								Action:     ActionDeclare,
-								Status:     StatusDeclareFailed,
-								StatusCode: StatusCodeFailed,
-								SectorIDs:  []string{strconv.Itoa(s.ID)},
-								MinerID:    t.minerID,
-								ErrMsg:     err.Error(),
-							}); err != nil {
-								log.Error().Msgf("[Transformer] callback err: %s", err)
-							}
-						*/
-
-						go func() {
-							s.Status = types.NeedTwo
-							t.ch <- s
-						}()
-
-						continue
-					}
-				}
+// Fetch enqueue the sector requested by a command
+func (t *Transformer) Fetch(s types.Sector) {
+	s.Manual = true
+	t.enqueue(s)
+}
 
-				if s.NeedCallback() {
-					if err := t.CallBack(DownloadCallBackContent{
-						Action:     ActionDeclare,
-						Status:     StatusDeclareSuccessful,
-						StatusCode: StatusCodeOK,
-						SectorIDs:  []string{strconv.Itoa(s.ID)},
-						MinerID:    t.minerID,
-					}); err != nil {
-						log.Error().Msgf("[Transformer] miner: %s, sector: %d callback err: %s, retru", t.minerID, s.ID, err)
-						go func() {
-							s.Status = types.NeedOne
-							t.ch <- s
-						}()
-
-						continue
-					}
-				}
+// Queue return the waiting sectors in order
+func (t *Transformer) Queue() []QueuedSector {
+	return t.queue.List()
+}
 
-				t.c.Set(strconv.Itoa(s.ID), "true", cache.DefaultExpiration)
-				t.UnProcessing(s.ID)
-			case <-t.ctx.Done():
-				return
-			}
+// fetch is the first stage, it downloads the sealed file and the cache tar of the sector.
+// It return false if the sector is retried or given up.
+func (t *Transformer) fetch(s types.Sector) (types.Sector, bool) {
+	log.Debug().Msgf("[Transformer] start download s: %+v", s)
+	// the settings may be reloaded, the sector keeps the ones it starts with
+	t.Lock()
+	maxRetry := t.MaxDownloadRetry
+	partSize, maxWorkers, sourceName := t.transformPartSize, t.singleDownloadMaxWorkers, t.defaultSource
+	t.Unlock()
+
+	s.Try += 1
+	if s.Try > maxRetry {
+		log.Info().Msgf("[Transformer] miner: %s, sector: %d retry too much, do failed callback", t.minerID, s.ID)
+
+		/*
+		   if err := t.CallBack(DownloadCallBackContent{
+		     Action:     ActionDownload,
+		     Status:     StatusDownloadFailed,
+		     StatusCode: StatusCodeFailed,
+		     SectorIDs:  []string{strconv.Itoa(s.ID)},
+		     MinerID:    t.minerID,
+		     ErrMsg:     ErrRetryExceed.Error(),
+		   }); err != nil {
+		     log.Error().Msgf("[Transformer] callback err: %s", err)
+		   }
+		*/
+
+		atomic.AddInt64(&t.progress.failed, 1)
+		t.Lock()
+		t.failed[s.ID] = true
+		t.Unlock()
+		t.UnProcessing(s.ID)
+		return s, false
+	}
+
+	ctx := t.sectorCtx(s.ID)
+	// skip the files lotus-miner already knows about, on every attempt as the miner may have them by now
+	t.reconcile(ctx, &s)
+
+	if s.Source != "" {
+		sourceName = s.Source
+	}
+	src, err := t.source(sourceName)
+	if err != nil {
+		log.Error().Msgf("[Transformer] miner: %s, sector: %d err: %s, retry", t.minerID, s.ID, err)
+		t.retry(s, s.Status)
+		return s, false
+	}
+
+	var (
+		target string
+		file   string
+	)
+
+	if s.NeedDownloadSealed() {
+		minerID := t.minerID
+		// the minerID may be t10000, f10000....., but we store it only named t10000
+		if !strings.HasPrefix(minerID, "t") {
+			minerID = "t" + minerID[1:]
 		}
-	}()
+		target = fmt.Sprintf("%s/s-%s-%d", t.SealedDir, minerID, s.ID)
+		file = SealedFile(t.minerID, s.ID)
+		if _, err := os.Stat(target); err == nil {
+			// remove if exist
+			log.Info().Msgf("[Transformer] target: %s exist, remove", target)
+			os.Remove(target)
+		}
+
+		log.Debug().Msgf("[Transformer] start download target: %s, src: %s %s", target, sourceName, file)
+		d := InitDownloader(src, file, target, "", t.minerID, partSize, maxWorkers, s.ID, false, true, ctx)
+		d.limiter, d.progress = t.limiter, t.progress
+		if err := t.download(ctx, d, t.SealedDir); err != nil {
+			log.Error().Msgf("[Transformer] Download sealed file failed, sector's metainfo: %+v, err: %s, retry", s, err)
+			// need retry
+			t.retry(s, types.NeedFour)
+			return s, false
+		}
+
+		log.Info().Msgf("[Transformer] miner: %s, sector: %d download sealed success", t.minerID, s.ID)
+		s.Status &^= types.NeedDownloadSealed
+	}
+
+	if s.NeedDownloadCache() {
+		target = fmt.Sprintf("%s/s-%s-%d", t.workDir, t.minerID, s.ID)
+		file = CacheFile(t.minerID, s.ID)
+
+		if _, err := os.Stat(target); err == nil {
+			// remove if exist
+			log.Info().Msgf("[Transformer] target: %s exist, remove", target)
+			os.Remove(target)
+		}
+
+		log.Debug().Msgf("[Transformer] start download target: %s, src: %s %s", target, sourceName, file)
+		// the tar is extracted by the extract stage
+		d := InitDownloader(src, file, target, t.CacheDir, t.minerID, partSize, maxWorkers, s.ID, false, false, ctx)
+		d.limiter, d.progress = t.limiter, t.progress
+		if err := t.download(ctx, d, t.workDir); err != nil {
+			log.Error().Msgf("[Transformer] DownloadFile cache failed, sector's metainfo: %+v, err: %s, retry", s, err)
+			// need retry
+			t.retry(s, types.NeedThree)
+			return s, false
+		}
+
+		log.Info().Msgf("[Transformer] miner: %s, sector: %d download cache tar success", t.minerID, s.ID)
+	}
+
+	return s, true
 }
 
-func (t *Transformer) DeclareSector(sectorID int) error {
-	// file download successfully, need send declare request to lotus-miner
-	if err := t.minerCli.SectorDeclare(sectorID, minerclient.FTSealed); err != nil {
-		return err
+// source return the named source, the platform file server and its mirrors if name is empty
+func (t *Transformer) source(name string) (Source, error) {
+	if name == "" {
+		return t.mirrors, nil
 	}
 
-	if err := t.minerCli.SectorDeclare(sectorID, minerclient.FTCache); err != nil {
-		return err
+	src, ok := t.sources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown source %s", name)
+	}
+
+	return src, nil
+}
+
+// Mirrors return the state of the platform mirrors
+func (t *Transformer) Mirrors() []MirrorStat {
+	return t.mirrors.Stats()
+}
+
+func (t *Transformer) DeclareSector(s types.Sector) error {
+	// file download successfully, need send declare request to lotus-miner
+	for _, f := range reconcileFiles {
+		if s.Located&f.need != 0 {
+			// the miner already holds this file in another storage
+			continue
+		}
+
+		if err := t.minerCli.SectorDeclare(s.ID, f.sft); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -340,20 +499,26 @@ type DownloadCallBackContent struct {
 	StatusCode int      `json:"statusCode,omitempty"`
 	SectorIDs  []string `json:"sectorIds,omitempty"`
 	MinerID    string   `json:"minerID,omitempty"`
+	AgentID    string   `json:"agentId,omitempty"`
 	ErrMsg     string   `json:"errMsg,omitempty"`
 }
 
 func (t *Transformer) CallBack(content DownloadCallBackContent) error {
+	content.AgentID = t.agentID
 	c, err := json.Marshal(content)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", t.callBackURL, bytes.NewReader(c))
+	t.Lock()
+	callBackURL, token := t.callBackURL, t.token
+	t.Unlock()
+
+	req, err := http.NewRequest("POST", callBackURL, bytes.NewReader(c))
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("minerToken", t.token)
+	req.Header.Set("minerToken", token)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := t.cli.Do(req)
 	if err != nil {
@@ -381,48 +546,33 @@ type Downloader struct {
 	maxWorkers int
 	// worker 在下载时下载的分片大小
 	partSize int
-	cli      *http.Client
-	// 文件在 GH 的 url
-	srcFileURL string
+	src      Source
+	// 文件在 source 中的路径
+	file string
 	// 文件在本地的绝对路径
 	targetFile string
 	// targetPath 解压 cache 压缩文件需要
 	targetPath    string
 	downCh        chan DownloadPart
 	decompression bool
-	wg            sync.WaitGroup
-	ctx           context.Context
-	cancel        context.CancelFunc
-	token         string
-	depart        bool
+	// partDone receives once a part is downloaded, it never blocks the workers
+	partDone chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	depart   bool
+	limiter  *Limiter
+	progress *progress
 }
 
 // todo: too many params
-func InitDownloader(downloadURL, targetFile, targetPath, token, minerID string, partSize, maxWorkers, sectorID int,
+func InitDownloader(src Source, file, targetFile, targetPath, minerID string, partSize, maxWorkers, sectorID int,
 	decompression, depart bool, ctx context.Context) *Downloader {
 	d := &Downloader{
-		cli: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-				TLSHandshakeTimeout:   5 * time.Second,
-				ResponseHeaderTimeout: 10 * time.Second,
-				MaxIdleConns:          50,
-				MaxIdleConnsPerHost:   1,
-				MaxConnsPerHost:       10,
-				IdleConnTimeout:       10 * time.Second,
-			},
-			// todo: config this timeout
-			// need increase if read response content timeout
-			Timeout: time.Duration(10) * time.Minute,
-		},
-		maxWorkers:    5,
+		src:           src,
+		file:          file,
+		maxWorkers:    maxWorkers,
 		partSize:      partSize,
-		srcFileURL:    downloadURL,
 		decompression: decompression,
-		token:         token,
-		wg:            sync.WaitGroup{},
 		depart:        depart,
 		targetFile:    targetFile,
 		targetPath:    targetPath,
@@ -430,6 +580,10 @@ func InitDownloader(downloadURL, targetFile, targetPath, token, minerID string,
 		sectorID:      sectorID,
 	}
 
+	if d.maxWorkers <= 0 {
+		d.maxWorkers = DefaultMaxWorkers
+	}
+
 	d.downCh = make(chan DownloadPart, 1024)
 	d.ctx, d.cancel = context.WithCancel(ctx)
 
@@ -454,13 +608,16 @@ func (d *Downloader) startDownloadWorker() {
 				log.Error().Msgf("[Downloader] retry download sector: %d. part: %+v, downloadRange err: %s\n", d.sectorID, p, err)
 				// retry until successfully
 				go func() {
-					d.downCh <- p
+					select {
+					case d.downCh <- p:
+					case <-d.ctx.Done():
+					}
 				}()
 				continue
 			}
 
 			log.Debug().Msgf("[Downloader download sector: %d part: %+v successfully", d.sectorID, p)
-			d.wg.Done()
+			d.partDone <- struct{}{}
 		case <-d.ctx.Done():
 			log.Debug().Msgf("[Downloader] worker's ctx done'")
 			return
@@ -469,28 +626,12 @@ func (d *Downloader) startDownloadWorker() {
 }
 
 func (d *Downloader) downloadRange(start, end int64) error {
-	// first, get file's lengh and check the range.
-	req, err := http.NewRequest("GET", d.srcFileURL, nil)
+	log.Debug().Msgf("[Downloader] downloadRange sector: %d file: %s range: %d-%d", d.sectorID, d.file, start, end)
+	r, err := d.src.Open(d.ctx, d.file, start, end)
 	if err != nil {
 		return err
 	}
-
-	req.Header.Set("Token", d.token)
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-	log.Debug().Msgf("[Downloader] downloadRange sector: %d req: %+v", d.sectorID, req)
-	resp, err := d.cli.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		b, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-
-		return fmt.Errorf("range download errstatus: %d, body: %s", resp.StatusCode, string(b))
-	}
+	defer r.Close()
 
 	fd, err := os.OpenFile(d.targetFile, os.O_WRONLY, os.FileMode(0644))
 	if err != nil {
@@ -503,7 +644,7 @@ func (d *Downloader) downloadRange(start, end int64) error {
 		return err
 	}
 
-	_, err = io.Copy(fd, resp.Body)
+	_, err = io.Copy(fd, countingReader(limitReader(d.ctx, r, d.limiter), d.progress))
 	if err != nil {
 		return err
 	}
@@ -511,79 +652,59 @@ func (d *Downloader) downloadRange(start, end int64) error {
 	return nil
 }
 
-// need change when server support Head a file.
-func (d *Downloader) headFile() (int64, error) {
-	// first get file's lenght and check the range.
-	req, err := http.NewRequest("GET", d.srcFileURL, nil)
-	if err != nil {
-		return -1, err
-	}
-
-	req.Header.Set("Token", d.token) // need configurable
-	req.Header.Set("Range", "bytes=0-1")
-	resp, err := d.cli.Do(req)
-	if err != nil {
-		return -1, err
-	}
-	defer resp.Body.Close()
-
-	s := strings.Split(resp.Header.Get("content-range"), "/")
-	if len(s) < 2 {
-		return -1, fmt.Errorf("range not supported")
-	}
-
-	len, _ := strconv.ParseInt(s[1], 10, 64)
-	return len, nil
-}
-
-func (d *Downloader) scheduleDownload(len int64) {
-	log.Debug().Msgf("[Downloader] start scheduleDownload")
+// parts split the file of len into the parts downloaded by the workers
+func (d *Downloader) parts(len int64) []DownloadPart {
 	count := len / int64(d.partSize)
+	parts := make([]DownloadPart, 0, count+1)
 	start := int64(0)
 	for i := int64(0); i < count; i++ {
 		part := DownloadPart{
 			start: int64(start),
 			end:   start + int64(d.partSize) - 1,
 		}
-
-		d.wg.Add(1)
-		d.downCh <- part
+		parts = append(parts, part)
 		start = part.end + 1
 	}
 
 	left := len % int64(d.partSize)
 	if left > 0 {
-		part := DownloadPart{
+		parts = append(parts, DownloadPart{
 			start: start,
 			end:   start + left - 1,
-		}
+		})
+	}
+
+	return parts
+}
 
-		d.wg.Add(1)
-		d.downCh <- part
+func (d *Downloader) scheduleDownload(parts []DownloadPart) error {
+	log.Debug().Msgf("[Downloader] start scheduleDownload")
+	for _, part := range parts {
+		select {
+		case d.downCh <- part:
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		}
 	}
 
 	log.Debug().Msgf("[Downloader] finish scheduleDownload")
+	return nil
 }
 
 func (d *Downloader) download() error {
-	// first get file's lenght and check the range.
-	req, err := http.NewRequest("GET", d.srcFileURL, nil)
+	r, err := d.src.Open(d.ctx, d.file, 0, -1)
 	if err != nil {
 		return err
 	}
-
-	req.Header.Set("Token", d.token)
-	resp, err := d.cli.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	defer r.Close()
 
 	fd, err := os.OpenFile(d.targetFile, os.O_WRONLY|os.O_CREATE, os.FileMode(0644))
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(fd, resp.Body)
+	defer fd.Close()
+
+	_, err = io.Copy(fd, countingReader(limitReader(d.ctx, r, d.limiter), d.progress))
 	if err != nil {
 		return err
 	}
@@ -598,12 +719,17 @@ func (d *Downloader) DownloadFile() error {
 			// do nothing
 			log.Debug().Msgf("[Downloader] targetfile: %s exist", d.targetFile)
 		} else {
+			if d.progress != nil {
+				// the size is only for the progress, the file is downloaded anyway
+				size, _ := d.src.Size(d.ctx, d.file)
+				d.progress.addTotal(size)
+			}
 			if err := d.download(); err != nil {
 				return err
 			}
 		}
 
-		log.Info().Interface("src", d.srcFileURL).Interface("target", d.targetFile).Msgf("[Downloader] download successfully")
+		log.Info().Interface("src", d.file).Interface("target", d.targetFile).Msgf("[Downloader] download successfully")
 	} else {
 		// create target file
 		fd, err := os.OpenFile(d.targetFile, os.O_WRONLY|os.O_CREATE, os.FileMode(0644))
@@ -613,21 +739,34 @@ func (d *Downloader) DownloadFile() error {
 		fd.Close()
 
 		// multipart download
-		len, err := d.headFile()
+		len, err := d.src.Size(d.ctx, d.file)
 		if err != nil {
 			return err
 		}
+		if d.progress != nil {
+			d.progress.addTotal(len)
+		}
 
+		parts := d.parts(len)
+		d.partDone = make(chan struct{}, cap(parts))
 		for i := 0; i < d.maxWorkers; i++ {
 			log.Debug().Msgf("[Downloader] startDownloadWorker")
 			go d.startDownloadWorker()
 		}
-		d.scheduleDownload(len)
+		if err := d.scheduleDownload(parts); err != nil {
+			return err
+		}
 
 		log.Info().Msgf("[Downloader] Waiting file downloaded")
-		// wait download finish
-		d.wg.Wait()
-		log.Info().Interface("src", d.srcFileURL).Interface("target", d.targetFile).Msgf("[Downloader] download successfully")
+		// wait download finish, or abort when the transformer stops
+		for range parts {
+			select {
+			case <-d.partDone:
+			case <-d.ctx.Done():
+				return d.ctx.Err()
+			}
+		}
+		log.Info().Interface("src", d.file).Interface("target", d.targetFile).Msgf("[Downloader] download successfully")
 	}
 
 	// stop all workers, avoid gorounine leak
@@ -635,26 +774,30 @@ func (d *Downloader) DownloadFile() error {
 
 	// cache file need decompress
 	if d.decompression {
-		log.Info().Msgf("[Downloader] untar targetFile: %s, targetPath: %s", d.targetFile, d.targetPath)
-		minerID := d.minerID
-		// the minerID may be t10000, f10000....., but we store it only named t10000
-		if !strings.HasPrefix(minerID, "t") {
-			minerID = "t" + minerID[1:]
-		}
+		return extractCache(d.targetFile, d.targetPath, d.minerID, d.sectorID)
+	}
 
-		os.Mkdir(fmt.Sprintf("%s/s-%s-%d", d.targetPath, minerID, d.sectorID), os.FileMode(0755))
-		if err := untar(d.targetFile, strings.TrimSuffix(d.targetPath, "cache")); err != nil {
-			log.Error().Msgf("[Downloader] untar err: %s\n", err)
-			// the file maybe broken, need retry
-			return err
-		}
+	// do nothing for sealed sector file here
+	return nil
+}
 
-		// do not forget rm the tar file
-		os.Remove(d.targetFile)
-	} else {
-		// do nothing for sealed sector file here
+// extractCache untar the cache tar of the sector into cacheDir, and remove the tar
+func extractCache(tarball, cacheDir, minerID string, sectorID int) error {
+	log.Info().Msgf("[Downloader] untar targetFile: %s, targetPath: %s", tarball, cacheDir)
+	// the minerID may be t10000, f10000....., but we store it only named t10000
+	if !strings.HasPrefix(minerID, "t") {
+		minerID = "t" + minerID[1:]
+	}
+
+	os.Mkdir(fmt.Sprintf("%s/s-%s-%d", cacheDir, minerID, sectorID), os.FileMode(0755))
+	if err := untar(tarball, strings.TrimSuffix(cacheDir, "cache")); err != nil {
+		log.Error().Msgf("[Downloader] untar err: %s\n", err)
+		// the file maybe broken, need retry
+		return err
 	}
 
+	// do not forget rm the tar file
+	os.Remove(tarball)
 	return nil
 }
 
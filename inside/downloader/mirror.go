@@ -0,0 +1,329 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// a mirror is demoted after MirrorMaxFailures failures in a row
+	MirrorMaxFailures = 3
+	// the demotion lasts MirrorMinBackoff, doubled every time until MirrorMaxBackoff
+	MirrorMinBackoff = 30 * time.Second
+	MirrorMaxBackoff = 5 * time.Minute
+	// the weight of the latest request in the throughput and error rate
+	mirrorEWMAWeight = 0.3
+)
+
+var errNoMirror = errors.New("no mirror configured")
+
+type mirror struct {
+	src      *httpSource
+	url      string
+	priority int
+	inflight int
+	// bytes per second, 0 if not measured yet
+	throughput float64
+	errorRate  float64
+	requests   int64
+	errors     int64
+	// failures in a row, reset by a success
+	failures     int
+	demotions    int
+	demotedUntil time.Time
+}
+
+// MirrorStat is the state of a mirror
+type MirrorStat struct {
+	URL          string
+	Priority     int
+	Inflight     int
+	Throughput   float64
+	ErrorRate    float64
+	Requests     int64
+	Errors       int64
+	DemotedUntil *time.Time `json:",omitempty"`
+}
+
+// mirrorSource spread the requests of the platform files across the mirrors. It prefers the mirrors
+// of the highest priority, and among them the one would finish a part first by throughput and in-flight parts.
+// A failing mirror is demoted for a while, a request failed mid-stream resumes from the bytes read
+// on another one, so a file fails over without downloading the finished parts or bytes again.
+type mirrorSource struct {
+	sync.Mutex
+	cli     *http.Client
+	mirrors []*mirror
+}
+
+func newMirrorSource(cli *http.Client) *mirrorSource {
+	return &mirrorSource{cli: cli}
+}
+
+// Set replace the mirrors with downloadURL of priority 0 and mirrors, the known ones keep their stats
+func (ms *mirrorSource) Set(downloadURL string, mirrors []config.MirrorConfig, token string) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	known := make(map[string]*mirror)
+	for _, m := range ms.mirrors {
+		known[m.url] = m
+	}
+
+	confs := make([]config.MirrorConfig, 0, len(mirrors)+1)
+	if downloadURL != "" {
+		confs = append(confs, config.MirrorConfig{URL: downloadURL})
+	}
+	confs = append(confs, mirrors...)
+
+	res := make([]*mirror, 0, len(confs))
+	seen := make(map[string]bool)
+	for _, c := range confs {
+		if seen[c.URL] {
+			continue
+		}
+		seen[c.URL] = true
+
+		m, ok := known[c.URL]
+		if !ok {
+			m = &mirror{url: c.URL}
+		}
+		m.priority = c.Priority
+		m.src = newHTTPSource(ms.cli, c.URL, token)
+		res = append(res, m)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].priority > res[j].priority
+	})
+	ms.mirrors = res
+}
+
+// pick the mirror for the next request and count it in-flight, nil if all are tried
+func (ms *mirrorSource) pick(tried map[*mirror]bool) *mirror {
+	ms.Lock()
+	defer ms.Unlock()
+
+	now := time.Now()
+	var (
+		best      *mirror
+		bestScore float64
+	)
+	for _, m := range ms.mirrors {
+		if tried[m] || now.Before(m.demotedUntil) {
+			continue
+		}
+		// sorted by priority, the lower ones are only used if all the higher ones are demoted
+		if best != nil && m.priority < best.priority {
+			break
+		}
+
+		// the seconds to finish one more part of the same size, an unmeasured mirror is tried first
+		score := 0.0
+		if m.throughput > 0 {
+			score = float64(m.inflight+1) / m.throughput
+		}
+		if best == nil || score < bestScore {
+			best, bestScore = m, score
+		}
+	}
+
+	if best == nil {
+		// all are demoted, use the one recovers first rather than stop
+		for _, m := range ms.mirrors {
+			if !tried[m] && (best == nil || m.demotedUntil.Before(best.demotedUntil)) {
+				best = m
+			}
+		}
+	}
+
+	if best != nil {
+		best.inflight++
+		best.requests++
+	}
+	return best
+}
+
+// done record the result of a request, n bytes are read in elapsed
+func (ms *mirrorSource) done(ctx context.Context, m *mirror, n int64, elapsed time.Duration, err error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	m.inflight--
+	if err != nil && ctx.Err() != nil {
+		// aborted by us, not the mirror's fault
+		return
+	}
+
+	if err != nil {
+		m.errors++
+		m.failures++
+		m.errorRate = ewma(m.errorRate, 1)
+		if m.failures >= MirrorMaxFailures {
+			backoff := MirrorMinBackoff << m.demotions
+			if backoff > MirrorMaxBackoff || backoff <= 0 {
+				backoff = MirrorMaxBackoff
+			}
+			m.demotedUntil = time.Now().Add(backoff)
+			m.demotions++
+			m.failures = 0
+			log.Warn().Msgf("[Mirror] %s failed %d times, demoted for %s, last err: %s", m.url, MirrorMaxFailures, backoff, err)
+		}
+		return
+	}
+
+	m.failures = 0
+	m.demotions = 0
+	m.errorRate = ewma(m.errorRate, 0)
+	if n > 0 && elapsed > 0 {
+		m.throughput = ewma(m.throughput, float64(n)/elapsed.Seconds())
+	}
+}
+
+func ewma(old, v float64) float64 {
+	if old == 0 {
+		return v
+	}
+
+	return old*(1-mirrorEWMAWeight) + v*mirrorEWMAWeight
+}
+
+// Stats return the state of all the mirrors
+func (ms *mirrorSource) Stats() []MirrorStat {
+	ms.Lock()
+	defer ms.Unlock()
+
+	res := make([]MirrorStat, 0, len(ms.mirrors))
+	for _, m := range ms.mirrors {
+		st := MirrorStat{
+			URL:        m.url,
+			Priority:   m.priority,
+			Inflight:   m.inflight,
+			Throughput: m.throughput,
+			ErrorRate:  m.errorRate,
+			Requests:   m.requests,
+			Errors:     m.errors,
+		}
+		if time.Now().Before(m.demotedUntil) {
+			until := m.demotedUntil
+			st.DemotedUntil = &until
+		}
+		res = append(res, st)
+	}
+
+	return res
+}
+
+func (ms *mirrorSource) Size(ctx context.Context, file string) (int64, error) {
+	tried := make(map[*mirror]bool)
+	err := errNoMirror
+	for m := ms.pick(tried); m != nil; m = ms.pick(tried) {
+		tried[m] = true
+		var size int64
+		size, err = m.src.Size(ctx, file)
+		ms.done(ctx, m, 0, 0, err)
+		if err == nil {
+			return size, nil
+		}
+		log.Warn().Msgf("[Mirror] %s size of %s err: %s, try next", m.url, file, err)
+	}
+
+	return -1, err
+}
+
+func (ms *mirrorSource) Open(ctx context.Context, file string, start, end int64) (io.ReadCloser, error) {
+	mr := &mirrorReader{ms: ms, ctx: ctx, file: file, start: start, end: end, tried: make(map[*mirror]bool)}
+	if err := mr.open(errNoMirror); err != nil {
+		return nil, err
+	}
+
+	return mr, nil
+}
+
+// mirrorReader measures the throughput of the mirror, the result is recorded when the mirror fails or
+// the reader is closed. A mirror failed mid-stream is replaced by another one from the bytes read.
+type mirrorReader struct {
+	r     io.ReadCloser
+	ms    *mirrorSource
+	m     *mirror
+	ctx   context.Context
+	file  string
+	start int64
+	end   int64
+	tried map[*mirror]bool
+	begin time.Time
+	// n is read from m, read is from all the mirrors
+	n    int64
+	read int64
+	err  error
+	once sync.Once
+}
+
+// open the rest of the range from a mirror not tried, err is returned if all are tried
+func (mr *mirrorReader) open(err error) error {
+	offset := mr.start + mr.read
+	for m := mr.ms.pick(mr.tried); m != nil; m = mr.ms.pick(mr.tried) {
+		mr.tried[m] = true
+		begin := time.Now()
+		r, oerr := m.src.Open(mr.ctx, mr.file, offset, mr.end)
+		if oerr == nil {
+			mr.r, mr.m, mr.begin, mr.n = r, m, begin, 0
+			return nil
+		}
+		mr.ms.done(mr.ctx, m, 0, 0, oerr)
+		log.Warn().Msgf("[Mirror] %s open %s err: %s, try next", m.url, mr.file, oerr)
+		err = oerr
+	}
+
+	return err
+}
+
+func (mr *mirrorReader) Read(p []byte) (int, error) {
+	if mr.err != nil {
+		return 0, mr.err
+	}
+
+	n, err := mr.r.Read(p)
+	mr.n += int64(n)
+	mr.read += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	// record the failed mirror and go on with the next one
+	mr.r.Close()
+	mr.ms.done(mr.ctx, mr.m, mr.n, time.Since(mr.begin), err)
+	if mr.ctx.Err() == nil {
+		log.Warn().Msgf("[Mirror] %s read %s err: %s, resume at %d from the next", mr.m.url, mr.file, err, mr.start+mr.read)
+		if oerr := mr.open(err); oerr == nil {
+			if n > 0 {
+				return n, nil
+			}
+			return mr.Read(p)
+		}
+	}
+
+	mr.err = err
+	return n, err
+}
+
+func (mr *mirrorReader) Close() error {
+	var err error
+	mr.once.Do(func() {
+		if mr.err != nil {
+			// the mirror is recorded and closed already
+			return
+		}
+		mr.ms.done(mr.ctx, mr.m, mr.n, time.Since(mr.begin), nil)
+		err = mr.r.Close()
+	})
+
+	return err
+}
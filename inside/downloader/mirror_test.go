@@ -0,0 +1,64 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+)
+
+func TestMirrorResume(t *testing.T) {
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	// broken sends the first half of the file and drops the connection
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer broken.Close()
+
+	var ranges []string
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer good.Close()
+
+	ms := newMirrorSource(http.DefaultClient)
+	ms.Set(broken.URL+"/", []config.MirrorConfig{{URL: good.URL + "/", Priority: -1}}, "")
+
+	r, err := ms.Open(context.Background(), "file", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(content))
+	}
+	if len(ranges) != 1 || ranges[0] == "" || ranges[0] == "bytes=0-" {
+		t.Fatalf("the next mirror should resume from the bytes read, ranges: %q", ranges)
+	}
+
+	stats := ms.Stats()
+	if stats[0].Errors != 1 || stats[0].Inflight != 0 || stats[1].Inflight != 0 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MoveProgress is the bytes copied of a moving sector, it is updated while moving
+type MoveProgress struct {
+	Total  int64 `json:"total"`
+	Copied int64 `json:"copied"`
+}
+
+func (p *MoveProgress) Load() MoveProgress {
+	return MoveProgress{Total: atomic.LoadInt64(&p.Total), Copied: atomic.LoadInt64(&p.Copied)}
+}
+
+// Move move the sealed and cache files of the sector from a local storage path of the miner to another.
+// The files are copied first, declared in the new path, then the old declarations and files are dropped.
+// The sector is processing while moving, so neither a fetch nor another move starts on it.
+func (t *Transformer) Move(ctx context.Context, sectorID int, from, to string, p *MoveProgress) error {
+	t.Lock()
+	if t.processingM[sectorID] {
+		t.Unlock()
+		return fmt.Errorf("sector %d is processing", sectorID)
+	}
+	// manual keeps it from being withdrawn as missing in the platform list
+	t.processingM[sectorID] = true
+	t.manual[sectorID] = true
+	t.Unlock()
+	defer t.UnProcessing(sectorID)
+
+	local, err := t.minerCli.StorageLocal()
+	if err != nil {
+		return fmt.Errorf("get miner local storage err: %s", err)
+	}
+
+	fromPath, ok := local[from]
+	if !ok {
+		return fmt.Errorf("storage %s is not local to the miner", from)
+	}
+	toPath, ok := local[to]
+	if !ok {
+		return fmt.Errorf("storage %s is not local to the miner", to)
+	}
+	if from == to {
+		return fmt.Errorf("sector %d is already in storage %s", sectorID, to)
+	}
+
+	name := storeName(t.minerID, sectorID)
+	for _, f := range reconcileFiles {
+		size, err := dirSize(filepath.Join(fromPath, f.sft.String(), name))
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&p.Total, size)
+	}
+
+	var moved []string
+	clean := func() {
+		for _, dst := range moved {
+			os.RemoveAll(dst)
+		}
+	}
+	for _, f := range reconcileFiles {
+		src := filepath.Join(fromPath, f.sft.String(), name)
+		dst := filepath.Join(toPath, f.sft.String(), name)
+		log.Info().Msgf("[Transformer] miner: %s, sector: %d copy %s to %s", t.minerID, sectorID, src, dst)
+		if err := copyAll(ctx, src, dst+".tmp", p); err != nil {
+			os.RemoveAll(dst + ".tmp")
+			clean()
+			return err
+		}
+		if err := os.Rename(dst+".tmp", dst); err != nil {
+			os.RemoveAll(dst + ".tmp")
+			clean()
+			return err
+		}
+		moved = append(moved, dst)
+	}
+
+	// declare all before drop any, the miner always finds a whole sector
+	for _, f := range reconcileFiles {
+		if err := t.minerCli.SectorDeclareIn(to, sectorID, f.sft); err != nil {
+			return fmt.Errorf("declare %s in %s err: %s", f.sft, to, err)
+		}
+	}
+
+	for _, f := range reconcileFiles {
+		if err := t.minerCli.SectorDrop(from, sectorID, f.sft); err != nil {
+			// the files are kept, the declaration left is harmless
+			log.Error().Msgf("[Transformer] miner: %s, sector: %d drop %s in storage: %s err: %s", t.minerID, sectorID, f.sft, from, err)
+			continue
+		}
+		os.RemoveAll(filepath.Join(fromPath, f.sft.String(), name))
+	}
+
+	log.Info().Msgf("[Transformer] miner: %s, sector: %d moved from %s to %s", t.minerID, sectorID, from, to)
+	return nil
+}
+
+// storeName is the file name of the sector in the storage
+func storeName(minerID string, sectorID int) string {
+	// the minerID may be t10000, f10000....., but we store it only named t10000
+	if !strings.HasPrefix(minerID, "t") {
+		minerID = "t" + minerID[1:]
+	}
+
+	return fmt.Sprintf("s-%s-%d", minerID, sectorID)
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// copyAll copy the file or the directory src to dst
+func copyAll(ctx context.Context, src, dst string, p *MoveProgress) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm())
+		}
+
+		return copyFile(ctx, path, target, fi.Mode().Perm(), p)
+	})
+}
+
+func copyFile(ctx context.Context, src, dst string, perm os.FileMode, p *MoveProgress) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, moveReader{ctx: ctx, r: in, p: p}); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// moveReader counts the bytes copied and stops once ctx is done
+type moveReader struct {
+	ctx context.Context
+	r   io.Reader
+	p   *MoveProgress
+}
+
+func (mr moveReader) Read(b []byte) (int, error) {
+	if err := mr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := mr.r.Read(b)
+	atomic.AddInt64(&mr.p.Copied, int64(n))
+	return n, err
+}
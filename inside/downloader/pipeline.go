@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bitrainforest/PandaAgent/inside/types"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	StageExtract  = "extract"
+	StageDeclare  = "declare"
+	StageCallback = "callback"
+	// DefaultStageWorkers is the workers of a stage if not configured
+	DefaultStageWorkers = 2
+)
+
+// stage is a step of the sector after fetch, it has its own workers and queue so the
+// network, the disk and the rpc bound steps of different sectors overlap.
+type stage struct {
+	name    string
+	workers int
+	// done is the bit of Sector.Status cleared once the stage succeeds
+	done types.SectorDownloadStatus
+	ch   chan types.Sector
+	// run return false if the sector is retried
+	run func(s types.Sector) bool
+	wg  sync.WaitGroup
+}
+
+func (t *Transformer) newStage(name string, workers int, done types.SectorDownloadStatus, run func(s types.Sector) bool) *stage {
+	if workers <= 0 {
+		workers = DefaultStageWorkers
+	}
+
+	return &stage{
+		name:    name,
+		workers: workers,
+		done:    done,
+		// a little buffer keeps the fetch workers downloading while the stage is busy
+		ch:  make(chan types.Sector, workers),
+		run: run,
+	}
+}
+
+// startStages start the workers of the stages after fetch. The stages are closed in order
+// once the upstream one exits, so the sectors in the pipeline are drained when stop.
+func (t *Transformer) startStages() {
+	for i, st := range t.stages {
+		for j := 0; j < st.workers; j++ {
+			st.wg.Add(1)
+			t.wg.Add(1)
+			go t.stageWorker(i, st)
+		}
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.fetchWG.Wait()
+		for _, st := range t.stages {
+			close(st.ch)
+			st.wg.Wait()
+		}
+	}()
+}
+
+func (t *Transformer) stageWorker(i int, st *stage) {
+	defer t.wg.Done()
+	defer st.wg.Done()
+
+	for s := range st.ch {
+		if t.ctx.Err() != nil {
+			// aborted, the sector is persisted and goes again from here on next start
+			t.retry(s, s.Status)
+			continue
+		}
+
+		if t.isWithdrawn(s.ID) {
+			t.drop(s)
+			continue
+		}
+
+		if st.run(s) {
+			// a retry or the next start goes on from the next stage
+			s.Status &^= st.done
+			t.forward(i+1, s)
+		}
+	}
+}
+
+// forward hand the sector to the i-th stage, it waits if the stage is busy. The sector is done after the last stage.
+func (t *Transformer) forward(i int, s types.Sector) {
+	if i >= len(t.stages) {
+		t.finish(s)
+		return
+	}
+
+	t.stages[i].ch <- s
+}
+
+func (t *Transformer) finish(s types.Sector) {
+	t.c.Set(strconv.Itoa(s.ID), "true", cache.DefaultExpiration)
+	t.Lock()
+	t.finished[s.ID] = true
+	t.Unlock()
+	t.UnProcessing(s.ID)
+	atomic.AddInt64(&t.progress.done, 1)
+	log.Info().Msgf("[Transformer] miner: %s, sector: %d done", t.minerID, s.ID)
+}
+
+// extract untar the cache tar downloaded by fetch
+func (t *Transformer) extract(s types.Sector) bool {
+	if !s.NeedDownloadCache() {
+		return true
+	}
+
+	tarball := fmt.Sprintf("%s/s-%s-%d", t.workDir, t.minerID, s.ID)
+	if err := extractCache(tarball, t.CacheDir, t.minerID, s.ID); err != nil {
+		log.Error().Msgf("[Transformer] miner: %s, sector: %d extract cache err: %s, retry", t.minerID, s.ID, err)
+		// the tar maybe broken, download it again
+		t.retry(s, types.NeedThree)
+		return false
+	}
+
+	log.Info().Msgf("[Transformer] miner: %s, sector: %d download cache success", t.minerID, s.ID)
+	return true
+}
+
+func (t *Transformer) declare(s types.Sector) bool {
+	/*
+		if err := t.CallBack(DownloadCallBackContent{
+			Action:     ActionDownload,
+			Status:     StatusDownloadSuccessful,
+			StatusCode: StatusCodeOK,
+			SectorIDs:  []string{strconv.Itoa(s.ID)},
+			MinerID:    t.minerID,
+		}); err != nil {
+			log.Error().Msgf("[Transformer] callback err: %s", err)
+		}
+	*/
+	if !s.NeedDeclare() {
+		return true
+	}
+
+	if err := t.DeclareSector(s); err != nil {
+		// if declare failed, we need user declare sector in current implement.
+		log.Error().Msgf("[Transformer] miner: %s DeclareSector: %d err: %s, retry", t.minerID, s.ID, err)
+		/*
+			if err := t.CallBack(DownloadCallBackContent{
+				Action:     ActionDeclare,
+				Status:     StatusDeclareFailed,
+				StatusCode: StatusCodeFailed,
+				SectorIDs:  []string{strconv.Itoa(s.ID)},
+				MinerID:    t.minerID,
+				ErrMsg:     err.Error(),
+			}); err != nil {
+				log.Error().Msgf("[Transformer] callback err: %s", err)
+			}
+		*/
+
+		t.retry(s, types.NeedTwo)
+		return false
+	}
+
+	t.dropStale(s.ID)
+	return true
+}
+
+func (t *Transformer) callback(s types.Sector) bool {
+	if !s.NeedCallback() {
+		return true
+	}
+
+	if err := t.CallBack(DownloadCallBackContent{
+		Action:     ActionDeclare,
+		Status:     StatusDeclareSuccessful,
+		StatusCode: StatusCodeOK,
+		SectorIDs:  []string{strconv.Itoa(s.ID)},
+		MinerID:    t.minerID,
+	}); err != nil {
+		log.Error().Msgf("[Transformer] miner: %s, sector: %d callback err: %s, retry", t.minerID, s.ID, err)
+		t.retry(s, types.NeedOne)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,167 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+// startWorkers resize the sector workers to MaxDownloader, the extra workers retire
+// once they finish the sector in hand.
+func (t *Transformer) startWorkers() {
+	select {
+	case <-t.stopping:
+		return
+	default:
+	}
+
+	t.Lock()
+	size := t.MaxDownloader
+	n := size - t.workers
+	if n > 0 {
+		t.workers += n
+	}
+	// wake up the idle workers to check if they should retire
+	t.poolCancel()
+	t.poolCtx, t.poolCancel = context.WithCancel(t.ctx)
+	t.Unlock()
+
+	for i := 0; i < n; i++ {
+		t.wg.Add(1)
+		t.fetchWG.Add(1)
+		go t.worker()
+	}
+
+	log.Info().Msgf("[Transformer] sector workers: %d", size)
+}
+
+// retire return true if the worker should exit, the worker count is decreased then
+func (t *Transformer) retire() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	select {
+	case <-t.stopping:
+	case <-t.ctx.Done():
+	default:
+		if t.workers <= t.MaxDownloader {
+			return false
+		}
+	}
+
+	t.workers--
+	return true
+}
+
+// worker fetch the sectors one by one and hand them to the next stages, the workers are
+// independent so a slow sector only holds its own worker.
+func (t *Transformer) worker() {
+	defer t.wg.Done()
+	defer t.fetchWG.Done()
+	for {
+		// finish the in-flight sector, but do not take a new one once stopping
+		if t.retire() {
+			log.Debug().Msgf("[Transformer] sector worker exit")
+			return
+		}
+
+		t.Lock()
+		poolCtx := t.poolCtx
+		t.Unlock()
+
+		s, ok := t.queue.Pop(t.stopping, poolCtx.Done())
+		if !ok {
+			// stopping or resized, check again
+			continue
+		}
+
+		if s, ok := t.fetch(s); ok {
+			t.forward(0, s)
+		}
+	}
+}
+
+// download the file once the disk of dir has a free slot
+func (t *Transformer) download(ctx context.Context, d *Downloader, dir string) error {
+	release, err := t.disks.Acquire(ctx, dir)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return d.DownloadFile()
+}
+
+// diskLimiter limits the files downloading to the same disk at the same time
+type diskLimiter struct {
+	sync.Mutex
+	// 0 means no limit
+	limit int
+	busy  map[uint64]int
+	// changed is closed and replaced when a disk is released
+	changed chan struct{}
+}
+
+func newDiskLimiter(limit int) *diskLimiter {
+	return &diskLimiter{
+		limit:   limit,
+		busy:    make(map[uint64]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetLimit change the limit, it is used by reload
+func (dl *diskLimiter) SetLimit(limit int) {
+	dl.Lock()
+	dl.limit = limit
+	close(dl.changed)
+	dl.changed = make(chan struct{})
+	dl.Unlock()
+}
+
+// Acquire wait until the disk of dir has a free slot, release must be called once the file is downloaded
+func (dl *diskLimiter) Acquire(ctx context.Context, dir string) (func(), error) {
+	dev := device(dir)
+	for {
+		dl.Lock()
+		if dl.limit <= 0 || dl.busy[dev] < dl.limit {
+			dl.busy[dev]++
+			dl.Unlock()
+			return func() { dl.release(dev) }, nil
+		}
+		changed := dl.changed
+		dl.Unlock()
+
+		log.Debug().Msgf("[Transformer] disk of %s is busy, wait", dir)
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (dl *diskLimiter) release(dev uint64) {
+	dl.Lock()
+	dl.busy[dev]--
+	close(dl.changed)
+	dl.changed = make(chan struct{})
+	dl.Unlock()
+}
+
+// device return the id of the disk dir is on, 0 if unknown so all the unknown ones share a limit
+func device(dir string) uint64 {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return 0
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+
+	return 0
+}
@@ -0,0 +1,251 @@
+package downloader
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/types"
+)
+
+const (
+	// PriorityUrgent is the priority of the sectors the platform marks urgent
+	PriorityUrgent = 100
+	// DefaultQueueAging raises the priority of a waiting sector by one every period
+	DefaultQueueAging = 10 * time.Minute
+)
+
+type queueItem struct {
+	s        types.Sector
+	enqueued time.Time
+	seq      int64
+}
+
+// QueuedSector is a sector waiting in the queue
+type QueuedSector struct {
+	ID       int
+	Miner    string `json:",omitempty"`
+	Priority int
+	// Effective is the priority with aging
+	Effective int
+	Waiting   string
+}
+
+// Queue is the sectors waiting to download. The one of the highest priority is taken first, the priority
+// of a waiting sector grows by one every aging period so the low ones are not starved. The miners of
+// the same priority take turns, and the sectors of a miner are taken in arrival order.
+type Queue struct {
+	sync.Mutex
+	items map[int]*queueItem
+	aging time.Duration
+	seq   int64
+	// turn counts the sectors taken, served is the turn a miner is taken last, the one served
+	// longest ago goes first
+	turn   int64
+	served map[string]int64
+	// notify wakes up a Pop waiting for sectors
+	notify chan struct{}
+}
+
+func NewQueue(aging time.Duration) *Queue {
+	if aging <= 0 {
+		aging = DefaultQueueAging
+	}
+
+	return &Queue{
+		items:  make(map[int]*queueItem),
+		aging:  aging,
+		served: make(map[string]int64),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// SetAging change the aging period, it is used by reload
+func (q *Queue) SetAging(aging time.Duration) {
+	if aging <= 0 {
+		aging = DefaultQueueAging
+	}
+
+	q.Lock()
+	q.aging = aging
+	q.Unlock()
+}
+
+// Push add the sector, a sector already waiting keeps the higher priority and its place
+func (q *Queue) Push(s types.Sector) {
+	q.Lock()
+	if it, ok := q.items[s.ID]; ok {
+		if s.Priority > it.s.Priority {
+			it.s.Priority = s.Priority
+		}
+	} else {
+		q.seq++
+		q.items[s.ID] = &queueItem{s: s, enqueued: time.Now(), seq: q.seq}
+	}
+	q.Unlock()
+
+	q.wakeup()
+}
+
+func (q *Queue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pop take the next sector, it waits until there is one, or stopping or done is closed
+func (q *Queue) Pop(stopping, done <-chan struct{}) (types.Sector, bool) {
+	for {
+		if s, ok := q.TryPop(); ok {
+			return s, true
+		}
+
+		select {
+		case <-q.notify:
+		case <-stopping:
+			return types.Sector{}, false
+		case <-done:
+			return types.Sector{}, false
+		}
+	}
+}
+
+// TryPop take the next sector if any
+func (q *Queue) TryPop() (types.Sector, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	var (
+		best    *queueItem
+		bestEff int
+	)
+	for _, it := range q.items {
+		eff := q.effective(it, now)
+		if best == nil || q.before(it, eff, best, bestEff) {
+			best, bestEff = it, eff
+		}
+	}
+
+	if best == nil {
+		return types.Sector{}, false
+	}
+
+	delete(q.items, best.s.ID)
+	q.turn++
+	q.served[best.s.Miner] = q.turn
+	if len(q.items) > 0 {
+		// let the other waiting Pop check again
+		q.wakeup()
+	}
+	return best.s, true
+}
+
+// before: higher effective priority, then the miner served longer ago, then the earlier one
+func (q *Queue) before(a *queueItem, aEff int, b *queueItem, bEff int) bool {
+	if aEff != bEff {
+		return aEff > bEff
+	}
+
+	if a.s.Miner != b.s.Miner && q.served[a.s.Miner] != q.served[b.s.Miner] {
+		return q.served[a.s.Miner] < q.served[b.s.Miner]
+	}
+
+	return a.seq < b.seq
+}
+
+func (q *Queue) effective(it *queueItem, now time.Time) int {
+	return it.s.Priority + int(now.Sub(it.enqueued)/q.aging)
+}
+
+// Bump set the priority of a waiting sector, return false if it is not waiting
+func (q *Queue) Bump(sectorID, priority int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	it, ok := q.items[sectorID]
+	if !ok {
+		return false
+	}
+
+	it.s.Priority = priority
+	return true
+}
+
+// Remove take the sector out of the queue, return false if it is not waiting
+func (q *Queue) Remove(sectorID int) (types.Sector, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	it, ok := q.items[sectorID]
+	if !ok {
+		return types.Sector{}, false
+	}
+
+	delete(q.items, sectorID)
+	return it.s, true
+}
+
+// Has return true if the sector is waiting
+func (q *Queue) Has(sectorID int) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.items[sectorID]
+	return ok
+}
+
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// List return the waiting sectors in the order they would be taken if nothing changes
+func (q *Queue) List() []QueuedSector {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	items := make([]*queueItem, 0, len(q.items))
+	for _, it := range q.items {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return q.before(items[i], q.effective(items[i], now), items[j], q.effective(items[j], now))
+	})
+
+	res := make([]QueuedSector, 0, len(items))
+	for _, it := range items {
+		res = append(res, QueuedSector{
+			ID:        it.s.ID,
+			Miner:     it.s.Miner,
+			Priority:  it.s.Priority,
+			Effective: q.effective(it, now),
+			Waiting:   now.Sub(it.enqueued).Truncate(time.Second).String(),
+		})
+	}
+
+	return res
+}
+
+// Drain remove all the waiting sectors
+func (q *Queue) Drain() []types.Sector {
+	q.Lock()
+	defer q.Unlock()
+
+	items := make([]*queueItem, 0, len(q.items))
+	for _, it := range q.items {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].seq < items[j].seq
+	})
+
+	res := make([]types.Sector, 0, len(items))
+	for _, it := range items {
+		res = append(res, it.s)
+	}
+	q.items = make(map[int]*queueItem)
+	return res
+}
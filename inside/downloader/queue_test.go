@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/types"
+)
+
+func popAll(q *Queue) []int {
+	var ids []int
+	for {
+		s, ok := q.TryPop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, s.ID)
+	}
+}
+
+func sameOrder(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := NewQueue(time.Hour)
+	q.Push(types.Sector{ID: 1})
+	q.Push(types.Sector{ID: 2, Priority: PriorityUrgent})
+	q.Push(types.Sector{ID: 3})
+	q.Push(types.Sector{ID: 4, Priority: 1})
+
+	if got := popAll(q); !sameOrder(got, []int{2, 4, 1, 3}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestQueueAging(t *testing.T) {
+	aging := time.Minute
+	q := NewQueue(aging)
+	q.Push(types.Sector{ID: 1})
+	q.Push(types.Sector{ID: 2, Priority: 2})
+
+	// not waited long enough, the higher one goes first
+	q.items[1].enqueued = time.Now().Add(-aging)
+	if got := q.List(); got[0].ID != 2 || got[1].Effective != 1 {
+		t.Fatalf("before aging: %+v", got)
+	}
+
+	// three aging periods raise it over the newer higher one
+	q.items[1].enqueued = time.Now().Add(-3 * aging)
+	if got := popAll(q); !sameOrder(got, []int{1, 2}) {
+		t.Fatalf("after aging: %v", got)
+	}
+}
+
+func TestQueueMinerTurns(t *testing.T) {
+	q := NewQueue(time.Hour)
+	for _, s := range []types.Sector{
+		{ID: 1, Miner: "t01000"},
+		{ID: 2, Miner: "t01000"},
+		{ID: 3, Miner: "t01000"},
+		{ID: 4, Miner: "t02000"},
+		{ID: 5, Miner: "t02000"},
+		{ID: 6, Miner: "t03000", Priority: 1},
+	} {
+		q.Push(s)
+	}
+
+	// the priority goes first, then the miners take turns in their arrival order
+	if got := popAll(q); !sameOrder(got, []int{6, 1, 4, 2, 5, 3}) {
+		t.Fatalf("got %v", got)
+	}
+}
@@ -0,0 +1,209 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bitrainforest/PandaAgent/inside/minerclient"
+	"github.com/bitrainforest/PandaAgent/inside/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ActionReconcile         = "reconcile"
+	StatusReconcileSkipped  = "skipped"
+	StatusReconcilePartial  = "partial"
+	StatusReconcileRelocate = "relocate"
+)
+
+type sectorFile struct {
+	need types.SectorDownloadStatus
+	sft  minerclient.SectorFileType
+}
+
+// staleDecl is a declaration left in a seal storage after the sector file is relocated,
+// path is the local copy dropped with it, empty if not reachable from here
+type staleDecl struct {
+	storageID string
+	sft       minerclient.SectorFileType
+	path      string
+}
+
+var reconcileFiles = []sectorFile{
+	{need: types.NeedDownloadSealed, sft: minerclient.FTSealed},
+	{need: types.NeedDownloadCache, sft: minerclient.FTCache},
+}
+
+// reconcile asks lotus-miner which files of the sector it already holds before we download anything.
+// A file held by a store path is skipped. A file only held by seal paths is relocated: copied into
+// our store path if the seal path is local to the miner, downloaded again otherwise. It is declared
+// in our store path and the seal path ones are dropped after. The outcome is reported to the platform
+// on the first attempt, and on a retry only if it changed.
+func (t *Transformer) reconcile(ctx context.Context, s *types.Sector) {
+	var (
+		located  types.SectorDownloadStatus
+		relocate bool
+		local    map[string]string
+		// a retry reports only what changed since the last attempt
+		before = s.Located | s.Relocated
+	)
+
+	for _, f := range reconcileFiles {
+		if s.Status&f.need == 0 {
+			continue
+		}
+
+		infos, err := t.minerCli.SectorLocate(s.ID, f.sft)
+		if err != nil {
+			log.Warn().Msgf("[Transformer] miner: %s, sector: %d locate %s err: %s, download anyway", t.minerID, s.ID, f.sft, err)
+			continue
+		}
+
+		if len(infos) == 0 {
+			continue
+		}
+
+		stored := false
+		for _, info := range infos {
+			if info.CanStore {
+				stored = true
+				log.Info().Msgf("[Transformer] miner: %s, sector: %d %s already in storage: %s, skip", t.minerID, s.ID, f.sft, info.ID)
+				break
+			}
+		}
+
+		if stored {
+			located |= f.need
+			continue
+		}
+
+		relocate = true
+		if local == nil {
+			if local, err = t.minerCli.StorageLocal(); err != nil {
+				log.Warn().Msgf("[Transformer] miner: %s, get local storage err: %s", t.minerID, err)
+				local = map[string]string{}
+			}
+		}
+
+		relocated := false
+		for _, info := range infos {
+			if info.ID == t.minerCli.StorageID() {
+				continue
+			}
+
+			d := staleDecl{storageID: info.ID, sft: f.sft}
+			if root, ok := local[info.ID]; ok {
+				d.path = filepath.Join(root, f.sft.String(), storeName(t.minerID, s.ID))
+				if !relocated {
+					relocated = t.relocate(ctx, s.ID, f, d.path)
+				}
+			}
+			t.addStale(s.ID, d)
+		}
+
+		if relocated {
+			s.Relocated |= f.need
+			s.Status &^= f.need
+			log.Info().Msgf("[Transformer] miner: %s, sector: %d %s relocated from seal storage to: %s", t.minerID, s.ID, f.sft, t.minerCli.StorageID())
+			continue
+		}
+
+		log.Info().Msgf("[Transformer] miner: %s, sector: %d %s only in seal storage, download again to: %s", t.minerID, s.ID, f.sft, t.minerCli.StorageID())
+	}
+
+	s.Located |= located
+	s.Status &^= located
+	if s.Located == types.NeedDownloadSealed|types.NeedDownloadCache {
+		// both files are already declared by the miner
+		s.Status &^= types.NeedDeclare
+	}
+
+	var status string
+	switch {
+	case relocate:
+		status = StatusReconcileRelocate
+	case located != 0 && s.Located == types.NeedDownloadSealed|types.NeedDownloadCache:
+		status = StatusReconcileSkipped
+	case located != 0:
+		status = StatusReconcilePartial
+	default:
+		return
+	}
+	if s.Try > 1 && s.Located|s.Relocated == before {
+		return
+	}
+
+	if err := t.CallBack(DownloadCallBackContent{
+		Action:     ActionReconcile,
+		Status:     status,
+		StatusCode: StatusCodeOK,
+		SectorIDs:  []string{strconv.Itoa(s.ID)},
+		MinerID:    t.minerID,
+	}); err != nil {
+		log.Error().Msgf("[Transformer] miner: %s, sector: %d reconcile callback err: %s", t.minerID, s.ID, err)
+	}
+}
+
+// relocate copy the file of the sector in a seal storage into our store path, it return false
+// if the copy failed and the file should be downloaded instead
+func (t *Transformer) relocate(ctx context.Context, sectorID int, f sectorFile, src string) bool {
+	dir := t.SealedDir
+	if f.sft == minerclient.FTCache {
+		dir = t.CacheDir
+	}
+	dst := filepath.Join(dir, storeName(t.minerID, sectorID))
+
+	if _, err := os.Stat(src); err != nil {
+		log.Warn().Msgf("[Transformer] miner: %s, sector: %d %s relocate err: %s", t.minerID, sectorID, f.sft, err)
+		return false
+	}
+
+	os.RemoveAll(dst)
+	if err := copyAll(ctx, src, dst+".tmp", &MoveProgress{}); err != nil {
+		log.Warn().Msgf("[Transformer] miner: %s, sector: %d %s relocate from %s err: %s", t.minerID, sectorID, f.sft, src, err)
+		os.RemoveAll(dst + ".tmp")
+		return false
+	}
+	if err := os.Rename(dst+".tmp", dst); err != nil {
+		log.Warn().Msgf("[Transformer] miner: %s, sector: %d %s relocate err: %s", t.minerID, sectorID, f.sft, err)
+		os.RemoveAll(dst + ".tmp")
+		return false
+	}
+
+	return true
+}
+
+// addStale record a declaration to drop once the sector is declared, a retry records it once
+func (t *Transformer) addStale(sectorID int, d staleDecl) {
+	t.Lock()
+	defer t.Unlock()
+	for _, e := range t.stale[sectorID] {
+		if e.storageID == d.storageID && e.sft == d.sft {
+			return
+		}
+	}
+	t.stale[sectorID] = append(t.stale[sectorID], d)
+}
+
+// dropStale drop the declarations the sector left in other storages once it is declared again.
+func (t *Transformer) dropStale(sectorID int) {
+	t.Lock()
+	decls := t.stale[sectorID]
+	delete(t.stale, sectorID)
+	t.Unlock()
+
+	for _, d := range decls {
+		if err := t.minerCli.SectorDrop(d.storageID, sectorID, d.sft); err != nil {
+			log.Error().Msgf("[Transformer] miner: %s, sector: %d drop stale %s in storage: %s err: %s", t.minerID, sectorID, d.sft, d.storageID, err)
+			continue
+		}
+
+		if d.path != "" {
+			// the copy in our store path is declared, the seal path one is not needed
+			os.RemoveAll(d.path)
+		}
+		log.Info().Msgf("[Transformer] miner: %s, sector: %d drop stale %s in storage: %s", t.minerID, sectorID, d.sft, d.storageID)
+	}
+}
@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrainforest/PandaAgent/inside/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// QueueFile keeps the unfinished sectors in WorkDir between restarts
+	QueueFile = "queue.json"
+)
+
+// Stop stop taking new sectors and wait the in-flight one to finish or checkpoint until ctx is done,
+// then abort the downloads and persist the unfinished sectors, they are restored on next Run.
+func (t *Transformer) Stop(ctx context.Context) {
+	log.Info().Msgf("[Transformer] Stop.")
+	t.stopOnce.Do(func() {
+		close(t.stopping)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info().Msgf("[Transformer] in-flight sectors drained")
+	case <-ctx.Done():
+		log.Warn().Msgf("[Transformer] drain timeout, abort the in-flight sectors")
+		t.cancel()
+		<-done
+	}
+
+	t.cancel()
+	if err := t.persist(); err != nil {
+		log.Error().Msgf("[Transformer] persist queue err: %s", err)
+	}
+
+	// release the connections the sources hold
+	for name, src := range t.sources {
+		if c, ok := src.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Error().Msgf("[Transformer] close source %s err: %s", name, err)
+			}
+		}
+	}
+}
+
+func (t *Transformer) queueFile() string {
+	return filepath.Join(t.workDir, QueueFile)
+}
+
+// persist write the queued sectors and the ones not taken from engine to the queue file
+func (t *Transformer) persist() error {
+	sectors := t.queue.Drain()
+DRAIN:
+	for {
+		select {
+		case s := <-t.buf:
+			sectors = append(sectors, s)
+		default:
+			break DRAIN
+		}
+	}
+
+	if len(sectors) == 0 {
+		os.Remove(t.queueFile())
+		return nil
+	}
+
+	content, err := json.Marshal(sectors)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(t.queueFile(), content, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("[Transformer] persist %d unfinished sectors to %s", len(sectors), t.queueFile())
+	return nil
+}
+
+// restore read the sectors persisted by the last Stop
+func (t *Transformer) restore() []types.Sector {
+	content, err := os.ReadFile(t.queueFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error().Msgf("[Transformer] read queue file err: %s", err)
+		}
+		return nil
+	}
+
+	var sectors []types.Sector
+	if err := json.Unmarshal(content, &sectors); err != nil {
+		log.Error().Msgf("[Transformer] bad queue file %s: %s", t.queueFile(), err)
+		return nil
+	}
+
+	for i := range sectors {
+		// an abort by stop is not a failure, the sector gets its retries again
+		sectors[i].Try = 0
+	}
+
+	os.Remove(t.queueFile())
+	log.Info().Msgf("[Transformer] restore %d unfinished sectors from %s", len(sectors), t.queueFile())
+	return sectors
+}
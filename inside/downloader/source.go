@@ -0,0 +1,139 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+)
+
+// Source is where the sector files are downloaded from, the files are named by the platform layout
+// like sealedsectors/<miner>/<sector>, see SealedFile and CacheFile.
+type Source interface {
+	// Size return the length of the file
+	Size(ctx context.Context, file string) (int64, error)
+	// Open read the file from start to end, end is included and -1 means the end of file
+	Open(ctx context.Context, file string, start, end int64) (io.ReadCloser, error)
+}
+
+// SealedFile is the sealed sector file in the source
+func SealedFile(minerID string, sectorID int) string {
+	return fmt.Sprintf("sealedsectors/%s/%d", minerID, sectorID)
+}
+
+// CacheFile is the tar of the sector cache in the source, we now support 32GB sector only
+func CacheFile(minerID string, sectorID int) string {
+	return fmt.Sprintf("sectortree/%s/32/%d", minerID, sectorID)
+}
+
+// NewSource build the source from configuration, cli is used by the http based ones
+func NewSource(conf config.SourceConfig, cli *http.Client) (Source, error) {
+	switch conf.Type {
+	case config.SourceHTTP:
+		return newHTTPSource(cli, conf.URL, conf.Token.Value()), nil
+	case config.SourceS3:
+		return newS3Source(cli, conf)
+	case config.SourceFS:
+		return newFSSource(conf.Path), nil
+	case config.SourceSFTP:
+		return newSFTPSource(conf)
+	}
+
+	return nil, fmt.Errorf("unknown source type %q", conf.Type)
+}
+
+// readCloser close c after r is read
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// section return the reader of [start, end] of r which is at start already
+func section(r io.ReadCloser, start, end int64) io.ReadCloser {
+	if end < 0 {
+		return r
+	}
+
+	return readCloser{Reader: io.LimitReader(r, end-start+1), Closer: r}
+}
+
+// httpSource is the platform file server, it needs the Token header
+type httpSource struct {
+	cli     *http.Client
+	baseURL string
+	token   string
+}
+
+func newHTTPSource(cli *http.Client, baseURL, token string) *httpSource {
+	return &httpSource{
+		cli:     cli,
+		baseURL: baseURL,
+		token:   token,
+	}
+}
+
+// Size need change when server support Head a file.
+func (h *httpSource) Size(ctx context.Context, file string) (int64, error) {
+	resp, err := h.get(ctx, file, "bytes=0-1")
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	s := strings.Split(resp.Header.Get("content-range"), "/")
+	if len(s) < 2 {
+		return -1, fmt.Errorf("range not supported")
+	}
+
+	return strconv.ParseInt(s[1], 10, 64)
+}
+
+func (h *httpSource) Open(ctx context.Context, file string, start, end int64) (io.ReadCloser, error) {
+	var rng string
+	if end >= 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", start, end)
+	} else if start > 0 {
+		rng = fmt.Sprintf("bytes=%d-", start)
+	}
+
+	resp, err := h.get(ctx, file, rng)
+	if err != nil {
+		return nil, err
+	}
+	if start > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the whole file, the bytes before start would be taken as the range
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s range %s not supported, status: %d", file, rng, resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+func (h *httpSource) get(ctx context.Context, file, rng string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.baseURL+file, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Token", h.token)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+
+	resp, err := h.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("get %s errstatus: %d, body: %s", file, resp.StatusCode, string(b))
+	}
+
+	return resp, nil
+}
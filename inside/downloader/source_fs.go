@@ -0,0 +1,46 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+)
+
+// fsSource is a local directory or a nfs mount keeps the files in the platform layout
+type fsSource struct {
+	dir string
+}
+
+func newFSSource(dir string) *fsSource {
+	return &fsSource{dir: util.ExpandHome(dir)}
+}
+
+func (f *fsSource) path(file string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(file))
+}
+
+func (f *fsSource) Size(ctx context.Context, file string) (int64, error) {
+	fi, err := os.Stat(f.path(file))
+	if err != nil {
+		return -1, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (f *fsSource) Open(ctx context.Context, file string, start, end int64) (io.ReadCloser, error) {
+	fd, err := os.Open(f.path(file))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fd.Seek(start, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return section(fd, start, end), nil
+}
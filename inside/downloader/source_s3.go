@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+)
+
+const (
+	DefaultS3Region = "us-east-1"
+	// the sha256 of the empty payload, GET and HEAD have no body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat    = "20060102T150405Z"
+)
+
+// s3Source is a bucket of a S3 compatible object storage like minio, the objects are addressed in path style
+// and the requests are signed with signature version 4.
+type s3Source struct {
+	cli       *http.Client
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func newS3Source(cli *http.Client, conf config.SourceConfig) (*s3Source, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("s3 source need a bucket")
+	}
+
+	s := &s3Source{
+		cli:       cli,
+		endpoint:  strings.TrimSuffix(conf.URL, "/"),
+		bucket:    conf.Bucket,
+		prefix:    strings.Trim(conf.Prefix, "/"),
+		region:    conf.Region,
+		accessKey: conf.AccessKey.Value(),
+		secretKey: conf.SecretKey.Value(),
+	}
+	if s.region == "" {
+		s.region = DefaultS3Region
+	}
+
+	return s, nil
+}
+
+func (s *s3Source) Size(ctx context.Context, file string) (int64, error) {
+	resp, err := s.do(ctx, "HEAD", file, "")
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return -1, fmt.Errorf("head %s: no content length", file)
+	}
+
+	return resp.ContentLength, nil
+}
+
+func (s *s3Source) Open(ctx context.Context, file string, start, end int64) (io.ReadCloser, error) {
+	var rng string
+	if end >= 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", start, end)
+	} else if start > 0 {
+		rng = fmt.Sprintf("bytes=%d-", start)
+	}
+
+	resp, err := s.do(ctx, "GET", file, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *s3Source) do(ctx context.Context, method, file, rng string) (*http.Response, error) {
+	key := path.Join(s.prefix, file)
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/"+awsEscape(s.bucket)+"/"+awsEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	signV4(req, s.accessKey, s.secretKey, s.region, time.Now())
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s/%s errstatus: %d, body: %s", method, s.bucket, key, resp.StatusCode, string(b))
+	}
+
+	return resp, nil
+}
+
+// signV4 sign the request without body in the Authorization header.
+// (https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html)
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape escape the object key like aws does, only the unreserved characters and / are kept
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,188 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	DefaultSFTPPort = "22"
+	sftpDialTimeout = 10 * time.Second
+)
+
+// sftpSource reads the files from a sftp server, the connection is shared by all downloads
+// and established again once it is broken.
+type sftpSource struct {
+	sync.Mutex
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+	conn   *ssh.Client
+	cli    *sftp.Client
+}
+
+func newSFTPSource(conf config.SourceConfig) (*sftpSource, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" || u.User == nil {
+		return nil, fmt.Errorf("sftp source url %q should be like sftp://user@host:22/path", conf.URL)
+	}
+
+	auth := make([]ssh.AuthMethod, 0, 2)
+	if conf.KeyFile != "" {
+		b, err := os.ReadFile(util.ExpandHome(conf.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s err: %s", conf.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		auth = append(auth, ssh.Password(conf.Password.Value()))
+	}
+
+	var hostKey ssh.HostKeyCallback
+	if conf.InsecureIgnoreHostKey {
+		log.Warn().Msgf("[Source] InsecureIgnoreHostKey is set for %s, the host key is NOT checked", u.Host)
+		hostKey = ssh.InsecureIgnoreHostKey()
+	} else {
+		hostKey, err = knownhosts.New(util.ExpandHome(conf.KnownHosts))
+		if err != nil {
+			return nil, fmt.Errorf("load known hosts err: %s", err)
+		}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), DefaultSFTPPort)
+	}
+
+	return &sftpSource{
+		addr: addr,
+		dir:  u.Path,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+			Timeout:         sftpDialTimeout,
+		},
+	}, nil
+}
+
+// client return the sftp client, connect if not yet
+func (s *sftpSource) client(ctx context.Context) (*sftp.Client, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.cli != nil {
+		return s.cli, nil
+	}
+
+	d := net.Dialer{Timeout: sftpDialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(c, chans, reqs)
+
+	cli, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.conn, s.cli = conn, cli
+	return cli, nil
+}
+
+// broken drop the connection if cli is still the current one, the next call connects again.
+// The file errors like not exist keep the connection.
+func (s *sftpSource) broken(cli *sftp.Client, err error) {
+	if _, ok := err.(*sftp.StatusError); ok || os.IsNotExist(err) || os.IsPermission(err) {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.cli != cli {
+		return
+	}
+
+	log.Warn().Msgf("[Source] sftp %s err: %s, reconnect", s.addr, err)
+	s.cli.Close()
+	s.conn.Close()
+	s.cli, s.conn = nil, nil
+}
+
+func (s *sftpSource) Size(ctx context.Context, file string) (int64, error) {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	fi, err := cli.Stat(path.Join(s.dir, file))
+	if err != nil {
+		s.broken(cli, err)
+		return -1, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (s *sftpSource) Open(ctx context.Context, file string, start, end int64) (io.ReadCloser, error) {
+	cli, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := cli.Open(path.Join(s.dir, file))
+	if err != nil {
+		s.broken(cli, err)
+		return nil, err
+	}
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return section(f, start, end), nil
+}
+
+// Close the connection, it is called when the transformer stops
+func (s *sftpSource) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.cli == nil {
+		return nil
+	}
+
+	s.cli.Close()
+	err := s.conn.Close()
+	s.cli, s.conn = nil, nil
+	return err
+}
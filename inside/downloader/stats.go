@@ -0,0 +1,208 @@
+package downloader
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// statsInterval is the period the throughput is sampled
+	statsInterval = 5 * time.Second
+)
+
+// progress counts the sectors and bytes the transformer handled since start
+type progress struct {
+	done    int64
+	failed  int64
+	started int64
+	// bytes of the files started and the bytes written, the retried files are counted again
+	bytesTotal int64
+	bytesDone  int64
+
+	sync.Mutex
+	lastBytes  int64
+	lastSample time.Time
+	throughput float64
+}
+
+func newProgress() *progress {
+	return &progress{lastSample: time.Now()}
+}
+
+// addTotal count a file about to download, size is 0 if unknown
+func (p *progress) addTotal(size int64) {
+	atomic.AddInt64(&p.started, 1)
+	if size > 0 {
+		atomic.AddInt64(&p.bytesTotal, size)
+	}
+}
+
+// sample update the throughput, it is called every statsInterval
+func (p *progress) sample() {
+	p.Lock()
+	defer p.Unlock()
+	now, bytes := time.Now(), atomic.LoadInt64(&p.bytesDone)
+	elapsed := now.Sub(p.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	p.throughput = ewma(p.throughput, float64(bytes-p.lastBytes)/elapsed)
+	p.lastBytes, p.lastSample = bytes, now
+}
+
+func (p *progress) rate() float64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.throughput
+}
+
+// countReader add the bytes read to the progress
+type countReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (cr countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&cr.p.bytesDone, int64(n))
+	}
+
+	return n, err
+}
+
+// countingReader wraps r with p, return r if p is nil
+func countingReader(r io.Reader, p *progress) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return countReader{r: r, p: p}
+}
+
+// the states of a sector
+const (
+	StateQueued     = "queued"
+	StateInProgress = "in_progress"
+	StateDone       = "done"
+	StateFailed     = "failed"
+	// StateUnknown is a sector never seen, withdrawn, or finished long ago
+	StateUnknown = "unknown"
+)
+
+// State return the state of the sector
+func (t *Transformer) State(sectorID int) string {
+	if t.queue.Has(sectorID) {
+		return StateQueued
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	switch {
+	case t.processingM[sectorID]:
+		return StateInProgress
+	case t.finished[sectorID]:
+		return StateDone
+	case t.failed[sectorID]:
+		return StateFailed
+	}
+
+	return StateUnknown
+}
+
+// DiskStat is the space of a storage path
+type DiskStat struct {
+	Path  string `json:"path"`
+	Free  uint64 `json:"free"`
+	Total uint64 `json:"total"`
+}
+
+// Stats is the progress of the transformer
+type Stats struct {
+	Queued     int   `json:"queued"`
+	InProgress int   `json:"in_progress"`
+	Done       int64 `json:"done"`
+	Failed     int64 `json:"failed"`
+	BytesDone  int64 `json:"bytes_done"`
+	BytesTotal int64 `json:"bytes_total"`
+	// Throughput is bytes per second
+	Throughput int64 `json:"throughput"`
+	// ETA is the estimated seconds to finish the sectors queued and in progress, 0 if unknown
+	ETA   int64      `json:"eta"`
+	Disks []DiskStat `json:"disks,omitempty"`
+}
+
+// Stats return the progress of the transformer
+func (t *Transformer) Stats() Stats {
+	st := Stats{
+		Queued:     t.queue.Len(),
+		Done:       atomic.LoadInt64(&t.progress.done),
+		Failed:     atomic.LoadInt64(&t.progress.failed),
+		BytesDone:  atomic.LoadInt64(&t.progress.bytesDone),
+		BytesTotal: atomic.LoadInt64(&t.progress.bytesTotal),
+		Throughput: int64(t.progress.rate()),
+	}
+
+	t.Lock()
+	// processingM holds the sectors from enqueue to finish, the queued ones included
+	st.InProgress = len(t.processingM) - st.Queued
+	t.Unlock()
+	if st.InProgress < 0 {
+		st.InProgress = 0
+	}
+
+	left := st.BytesTotal - st.BytesDone
+	if left < 0 {
+		left = 0
+	}
+	// the size of a queued sector is unknown before download, take the average of the started files
+	if started := atomic.LoadInt64(&t.progress.started); started > 0 {
+		// a sector is a sealed file and a cache tar
+		left += int64(st.Queued) * 2 * st.BytesTotal / started
+	}
+	if st.Throughput > 0 && st.Queued+st.InProgress > 0 {
+		st.ETA = left / st.Throughput
+	}
+
+	seen := make(map[uint64]bool)
+	for _, dir := range []string{t.SealedDir, t.CacheDir, t.workDir} {
+		dev := device(dir)
+		if seen[dev] {
+			continue
+		}
+		seen[dev] = true
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(dir, &fs); err != nil {
+			continue
+		}
+		st.Disks = append(st.Disks, DiskStat{
+			Path:  dir,
+			Free:  fs.Bavail * uint64(fs.Bsize),
+			Total: fs.Blocks * uint64(fs.Bsize),
+		})
+	}
+
+	return st
+}
+
+// sampleStats update the throughput until the transformer stops
+func (t *Transformer) sampleStats() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.progress.sample()
+		case <-t.stopping:
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bitrainforest/PandaAgent/inside/types"
+	"github.com/rs/zerolog/log"
+)
+
+// WithdrawAfter is the polls in a row a sector must be missing from the platform list before withdrawn
+const WithdrawAfter = 3
+
+// Sync diff the sectors the platform lists with the local state and return the ones to enqueue.
+// The new sectors are downloaded, and the finished ones still listed do the callback again once.
+// complete tells the list is the whole one, only then the local sectors missing there for
+// WithdrawAfter polls are withdrawn and the finished ones are forgotten. An empty list is
+// never trusted to withdraw.
+func (t *Transformer) Sync(list []types.Sector, complete bool) []types.Sector {
+	listed := make(map[int]bool, len(list))
+	res := make([]types.Sector, 0, len(list))
+	var withdraw []int
+
+	t.Lock()
+	for _, s := range list {
+		listed[s.ID] = true
+		delete(t.missing, s.ID)
+		if t.processingM[s.ID] {
+			continue
+		}
+
+		if t.finished[s.ID] {
+			if t.recalled[s.ID] {
+				continue
+			}
+			// the platform missed the callback, do not download again
+			log.Info().Msgf("[Transformer] miner: %s, sector: %d finished but still listed, callback again", t.minerID, s.ID)
+			t.recalled[s.ID] = true
+			s.Status = types.NeedOne
+		}
+		res = append(res, s)
+	}
+
+	if complete && len(list) > 0 {
+		for id := range t.processingM {
+			if listed[id] || t.manual[id] {
+				continue
+			}
+
+			t.missing[id]++
+			if t.missing[id] >= WithdrawAfter {
+				withdraw = append(withdraw, id)
+			}
+		}
+	}
+
+	if complete {
+		// the platform forgets the finished sectors once it gets the callback
+		for id := range t.finished {
+			if !listed[id] {
+				delete(t.finished, id)
+				delete(t.recalled, id)
+			}
+		}
+	}
+	t.Unlock()
+
+	for _, id := range withdraw {
+		t.Withdraw(id)
+	}
+
+	return res
+}
+
+// Withdraw cancel the sector, the waiting one is dropped at once and the in-flight one is aborted
+// and dropped by the stage holding it. The files the sector staged are removed.
+func (t *Transformer) Withdraw(sectorID int) error {
+	t.Lock()
+	if !t.processingM[sectorID] {
+		t.Unlock()
+		return fmt.Errorf("sector %d is not processing", sectorID)
+	}
+	t.withdrawn[sectorID] = true
+	f, ok := t.inflight[sectorID]
+	t.Unlock()
+
+	log.Info().Msgf("[Transformer] miner: %s, sector: %d withdrawn by the platform", t.minerID, sectorID)
+	if s, ok := t.queue.Remove(sectorID); ok {
+		t.drop(s)
+		return nil
+	}
+
+	if ok {
+		f.cancel()
+	}
+
+	return nil
+}
+
+// inflight is the context of a sector taken from the queue
+type inflight struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// sectorCtx return the context of the sector downloads, it is canceled when the sector is withdrawn
+func (t *Transformer) sectorCtx(sectorID int) context.Context {
+	t.Lock()
+	defer t.Unlock()
+	f, ok := t.inflight[sectorID]
+	if !ok {
+		f.ctx, f.cancel = context.WithCancel(t.ctx)
+		t.inflight[sectorID] = f
+	}
+
+	return f.ctx
+}
+
+func (t *Transformer) isWithdrawn(sectorID int) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.withdrawn[sectorID]
+}
+
+// drop give up the withdrawn sector and remove the files it staged. The files are kept once
+// declared as lotus-miner owns them, and the located ones are never ours.
+func (t *Transformer) drop(s types.Sector) {
+	minerID := t.minerID
+	// the minerID may be t10000, f10000....., but we store it only named t10000
+	if !strings.HasPrefix(minerID, "t") {
+		minerID = "t" + minerID[1:]
+	}
+
+	os.Remove(fmt.Sprintf("%s/s-%s-%d", t.workDir, t.minerID, s.ID))
+	// a sector never taken is not reconciled yet, the files there may be the miner's
+	if s.Try > 0 && s.NeedDeclare() {
+		if s.Located&types.NeedDownloadSealed == 0 {
+			os.Remove(fmt.Sprintf("%s/s-%s-%d", t.SealedDir, minerID, s.ID))
+		}
+		if s.Located&types.NeedDownloadCache == 0 {
+			os.RemoveAll(fmt.Sprintf("%s/s-%s-%d", t.CacheDir, minerID, s.ID))
+		}
+	}
+
+	// the stale declarations belong to this assignment, a later one relocates again
+	t.Lock()
+	delete(t.stale, s.ID)
+	t.Unlock()
+	t.UnProcessing(s.ID)
+	log.Info().Msgf("[Transformer] miner: %s, sector: %d dropped", t.minerID, s.ID)
+}
@@ -0,0 +1,213 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/types"
+	"github.com/patrickmn/go-cache"
+)
+
+func testTransformer(t *testing.T) *Transformer {
+	dir := t.TempDir()
+	tr := &Transformer{
+		minerID:     "t01000",
+		SealedDir:   filepath.Join(dir, "sealed"),
+		CacheDir:    filepath.Join(dir, "cache"),
+		workDir:     filepath.Join(dir, "work"),
+		processingM: make(map[int]bool),
+		stale:       make(map[int][]staleDecl),
+		c:           cache.New(5*time.Minute, 10*time.Minute),
+		finished:    make(map[int]bool),
+		recalled:    make(map[int]bool),
+		missing:     make(map[int]int),
+		withdrawn:   make(map[int]bool),
+		inflight:    make(map[int]inflight),
+		manual:      make(map[int]bool),
+		failed:      make(map[int]bool),
+		queue:       NewQueue(0),
+	}
+	tr.ctx, tr.cancel = context.WithCancel(context.Background())
+	t.Cleanup(tr.cancel)
+	for _, d := range []string{tr.SealedDir, tr.CacheDir, tr.workDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tr
+}
+
+// stageFiles write the sealed file and the cache directory of the sector
+func stageFiles(t *testing.T, tr *Transformer, sectorID int) (sealed, cacheDir string) {
+	name := storeName(tr.minerID, sectorID)
+	sealed, cacheDir = filepath.Join(tr.SealedDir, name), filepath.Join(tr.CacheDir, name)
+	if err := os.WriteFile(sealed, []byte("sealed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, "p_aux"), []byte("aux"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed, cacheDir
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (t *Transformer) isProcessing(sectorID int) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.processingM[sectorID]
+}
+
+func TestSyncWithdraw(t *testing.T) {
+	tr := testTransformer(t)
+	tr.enqueue(types.Sector{ID: 1, Status: types.NeedFour})
+	tr.enqueue(types.Sector{ID: 2, Status: types.NeedFour})
+	other := []types.Sector{{ID: 2}}
+
+	for i := 1; i < WithdrawAfter; i++ {
+		tr.Sync(other, true)
+		if !tr.isProcessing(1) || !tr.queue.Has(1) {
+			t.Fatalf("sector 1 is withdrawn after %d lists", i)
+		}
+	}
+
+	// listed again, the count starts over
+	tr.Sync([]types.Sector{{ID: 1}, {ID: 2}}, true)
+	for i := 1; i < WithdrawAfter; i++ {
+		tr.Sync(other, true)
+	}
+	if !tr.isProcessing(1) {
+		t.Fatal("the missing count is not reset once listed")
+	}
+
+	tr.Sync(other, true)
+	if tr.isProcessing(1) || tr.queue.Has(1) {
+		t.Fatalf("sector 1 is kept after %d lists", WithdrawAfter)
+	}
+	if !tr.isProcessing(2) || !tr.queue.Has(2) {
+		t.Fatal("the listed sector is withdrawn")
+	}
+}
+
+func TestSyncNeverWithdraw(t *testing.T) {
+	tr := testTransformer(t)
+	tr.enqueue(types.Sector{ID: 1, Status: types.NeedFour})
+	tr.enqueue(types.Sector{ID: 2, Status: types.NeedFour, Manual: true})
+
+	for i := 0; i < WithdrawAfter*2; i++ {
+		// a page of the list
+		tr.Sync([]types.Sector{{ID: 3}}, false)
+		// an empty list
+		tr.Sync(nil, true)
+		// the manual one is never withdrawn
+		tr.Sync([]types.Sector{{ID: 1}}, true)
+	}
+	if !tr.isProcessing(1) || !tr.queue.Has(1) {
+		t.Fatal("sector 1 is withdrawn")
+	}
+	if !tr.isProcessing(2) || !tr.queue.Has(2) {
+		t.Fatal("the manual sector is withdrawn")
+	}
+}
+
+func TestWithdrawFiles(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		sector types.Sector
+		// removed tells the staged sealed and cache files are removed
+		removed bool
+	}{
+		{"staged", types.Sector{Try: 1, Status: types.NeedDeclare | types.NeedCallback}, true},
+		{"declared", types.Sector{Try: 1, Status: types.NeedCallback}, false},
+		{"located", types.Sector{Try: 1, Status: types.NeedDeclare | types.NeedCallback,
+			Located: types.NeedDownloadSealed | types.NeedDownloadCache}, false},
+		{"never taken", types.Sector{Status: types.NeedFour}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tr := testTransformer(t)
+			s := c.sector
+			s.ID = 1
+			sealed, cacheDir := stageFiles(t, tr, s.ID)
+			tr.enqueue(s)
+
+			for i := 0; i < WithdrawAfter; i++ {
+				tr.Sync([]types.Sector{{ID: 2}}, true)
+			}
+			if tr.isProcessing(s.ID) {
+				t.Fatal("the sector is not withdrawn")
+			}
+			if exists(sealed) == c.removed || exists(cacheDir) == c.removed {
+				t.Fatalf("sealed exists: %v, cache exists: %v, want removed: %v", exists(sealed), exists(cacheDir), c.removed)
+			}
+		})
+	}
+}
+
+func TestWithdrawLocatedPartly(t *testing.T) {
+	tr := testTransformer(t)
+	s := types.Sector{ID: 1, Try: 1, Status: types.NeedDeclare | types.NeedCallback, Located: types.NeedDownloadSealed}
+	sealed, cacheDir := stageFiles(t, tr, s.ID)
+	tr.enqueue(s)
+
+	for i := 0; i < WithdrawAfter; i++ {
+		tr.Sync(nil, true)
+		tr.Sync([]types.Sector{{ID: 2}}, true)
+	}
+	if !exists(sealed) {
+		t.Fatal("the located sealed file is removed")
+	}
+	if exists(cacheDir) {
+		t.Fatal("the staged cache is kept")
+	}
+}
+
+func TestDropForgetsStale(t *testing.T) {
+	tr := testTransformer(t)
+	tr.enqueue(types.Sector{ID: 1, Status: types.NeedFour})
+	tr.addStale(1, staleDecl{storageID: "seal", sft: 1})
+
+	if err := tr.Withdraw(1); err != nil {
+		t.Fatal(err)
+	}
+	tr.Lock()
+	defer tr.Unlock()
+	if len(tr.stale[1]) != 0 {
+		t.Fatal("the stale declarations of the dropped sector are kept")
+	}
+}
+
+func TestSyncFinished(t *testing.T) {
+	tr := testTransformer(t)
+	tr.finished[1] = true
+
+	// the platform missed the callback, it is sent again once
+	if res := tr.Sync([]types.Sector{{ID: 1, Status: types.NeedFour}}, true); len(res) != 1 || res[0].Status != types.NeedOne {
+		t.Fatalf("callback again: %+v", res)
+	}
+	if res := tr.Sync([]types.Sector{{ID: 1, Status: types.NeedFour}}, true); len(res) != 0 {
+		t.Fatalf("callback twice: %+v", res)
+	}
+
+	// a page does not tell the platform forgets it
+	tr.Sync(nil, false)
+	if !tr.finished[1] {
+		t.Fatal("the finished sector is forgotten by a page")
+	}
+
+	// an empty whole list does
+	tr.Sync(nil, true)
+	if tr.finished[1] || tr.recalled[1] {
+		t.Fatal("the finished sector is kept")
+	}
+}
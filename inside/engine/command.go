@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/checker"
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/connector"
+	"github.com/bitrainforest/PandaAgent/inside/downloader"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// progressInterval is the period the progress of a command is replied
+	progressInterval = 10 * time.Second
+	// execTimeout kills the program of the shell and python modules
+	execTimeout = 10 * time.Minute
+	// Python runs the scripts of the python module
+	Python = "python3"
+)
+
+// command start the module of msg, the progress and the result are replied to its session
+func (eg *Engine) command(msg *connector.Message) error {
+	switch msg.Module {
+	case connector.FetchModule:
+		return eg.fetch(msg)
+	case connector.CopyModule:
+		return eg.copy(msg)
+	case connector.ShellModule, connector.PythonModule:
+		return eg.exec(msg)
+	default:
+		return fmt.Errorf("unsupported module: %s", msg.Module)
+	}
+}
+
+// reply send out as json, or err
+func (eg *Engine) reply(session string, out interface{}, err error) {
+	if err != nil {
+		eg.Client.Response(session, connector.NewJsonMessage("", err.Error()))
+		return
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		eg.Client.Response(session, connector.NewJsonMessage("", err.Error()))
+		return
+	}
+
+	eg.Client.Response(session, connector.NewJsonMessage(string(b), ""))
+}
+
+type sectorState struct {
+	SectorID int    `json:"sectorId"`
+	State    string `json:"state"`
+}
+
+// fetch enqueue the sector and reply its state until it is done or failed
+func (eg *Engine) fetch(msg *connector.Message) error {
+	var p connector.FetchPayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		return err
+	}
+
+	if _, err := strconv.Atoi(p.SectorID); err != nil {
+		return fmt.Errorf("bad sector id %q", p.SectorID)
+	}
+
+	sectors := eg.Checker.Sectors([]checker.DataItem{{
+		MinerID:  eg.minerID,
+		SectorId: p.SectorID,
+		Source:   p.Source,
+		Urgent:   p.Urgent,
+		Priority: p.Priority,
+	}})
+	s := sectors[0]
+
+	switch eg.Transformer.State(s.ID) {
+	case downloader.StateQueued, downloader.StateInProgress:
+		log.Info().Msgf("[Engine] sector: %d is already processing", s.ID)
+	default:
+		log.Info().Msgf("[Engine] sector: %d fetch by command", s.ID)
+		eg.Transformer.Fetch(s)
+	}
+
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			state := eg.Transformer.State(s.ID)
+			eg.reply(msg.Session, sectorState{SectorID: s.ID, State: state}, nil)
+			if state != downloader.StateQueued && state != downloader.StateInProgress {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-eg.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+type moveState struct {
+	SectorID int    `json:"sectorId"`
+	Done     bool   `json:"done"`
+	Total    int64  `json:"total"`
+	Copied   int64  `json:"copied"`
+	Error    string `json:"error,omitempty"`
+}
+
+// copy move the sector between the storage paths, and reply the bytes copied until it is done
+func (eg *Engine) copy(msg *connector.Message) error {
+	var p connector.CopyPayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		return err
+	}
+
+	sectorID, err := strconv.Atoi(p.SectorID)
+	if err != nil {
+		return fmt.Errorf("bad sector id %q", p.SectorID)
+	}
+
+	go func() {
+		progress := &downloader.MoveProgress{}
+		done := make(chan error, 1)
+		go func() {
+			done <- eg.Transformer.Move(eg.ctx, sectorID, p.From, p.To, progress)
+		}()
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mp := progress.Load()
+				eg.reply(msg.Session, moveState{SectorID: sectorID, Total: mp.Total, Copied: mp.Copied}, nil)
+			case err := <-done:
+				mp := progress.Load()
+				st := moveState{SectorID: sectorID, Done: true, Total: mp.Total, Copied: mp.Copied}
+				if err != nil {
+					log.Error().Msgf("[Engine] sector: %d move from %s to %s err: %s", sectorID, p.From, p.To, err)
+					st.Error = err.Error()
+				}
+				eg.reply(msg.Session, st, nil)
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// exec run the allowlisted program of the shell module or script of the python module, not through a shell
+func (eg *Engine) exec(msg *connector.Message) error {
+	var p connector.ExecPayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil {
+		return err
+	}
+
+	conf := config.GetConfig()
+	allowed := conf.Connector.Shell
+	if msg.Module == connector.PythonModule {
+		allowed = conf.Connector.Python
+	}
+	if !allow(allowed, p.Command, p.Args) {
+		return fmt.Errorf("%s %q %q is not allowed", msg.Module, p.Command, p.Args)
+	}
+
+	name, args := p.Command, p.Args
+	if msg.Module == connector.PythonModule {
+		name, args = Python, append([]string{p.Command}, p.Args...)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(eg.ctx, execTimeout)
+		defer cancel()
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		log.Info().Msgf("[Engine] %s run: %s %v", msg.Module, name, args)
+		errMsg := ""
+		if err := cmd.Run(); err != nil {
+			log.Error().Msgf("[Engine] %s run: %s err: %s", msg.Module, name, err)
+			errMsg = err.Error() + "\n"
+		}
+		errMsg += stderr.String()
+		eg.Client.Response(msg.Session, connector.NewJsonMessage(stdout.String(), errMsg))
+	}()
+
+	return nil
+}
+
+// allow check the whole command line against the patterns, a * matches one argument not starting with -,
+// so a flag like -exec can not be passed in
+func allow(patterns []string, command string, args []string) bool {
+	line := append([]string{command}, args...)
+	for _, pattern := range patterns {
+		if match(strings.Fields(pattern), line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func match(pattern, line []string) bool {
+	if len(pattern) != len(line) || len(line) == 0 || line[0] != pattern[0] {
+		return false
+	}
+	for i := 1; i < len(line); i++ {
+		if pattern[i] == "*" {
+			if line[i] == "" || strings.HasPrefix(line[i], "-") {
+				return false
+			}
+			continue
+		}
+		if line[i] != pattern[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,43 @@
+package engine
+
+import "testing"
+
+func TestAllow(t *testing.T) {
+	patterns := []string{
+		"df -h /data",
+		"check.py *",
+		"du -s * /data",
+	}
+
+	for _, c := range []struct {
+		name     string
+		patterns []string
+		command  string
+		args     []string
+		want     bool
+	}{
+		{"exact", patterns, "df", []string{"-h", "/data"}, true},
+		{"exact other arg", patterns, "df", []string{"-h", "/etc"}, false},
+		{"star one arg", patterns, "check.py", []string{"t01000"}, true},
+		{"star in the middle", patterns, "du", []string{"-s", "/mnt", "/data"}, true},
+		{"star flag", patterns, "check.py", []string{"-exec"}, false},
+		{"star long flag", patterns, "check.py", []string{"--exec=sh"}, false},
+		{"star empty arg", patterns, "check.py", []string{""}, false},
+		{"star two args", patterns, "check.py", []string{"a", "b"}, false},
+		{"extra arg", patterns, "df", []string{"-h", "/data", "-exec"}, false},
+		{"missing arg", patterns, "df", []string{"-h"}, false},
+		{"missing star arg", patterns, "check.py", nil, false},
+		{"command prefix", patterns, "d", []string{"-h", "/data"}, false},
+		{"command extended", patterns, "dfx", []string{"-h", "/data"}, false},
+		{"command as star", []string{"* -h"}, "rm", []string{"-h"}, false},
+		{"not listed", patterns, "rm", []string{"-rf", "/"}, false},
+		{"no patterns", nil, "df", []string{"-h", "/data"}, false},
+		{"empty pattern", []string{""}, "df", nil, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := allow(c.patterns, c.command, c.args); got != c.want {
+				t.Fatalf("allow(%q, %q) = %v, want %v", c.command, c.args, got, c.want)
+			}
+		})
+	}
+}
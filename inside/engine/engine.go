@@ -2,8 +2,11 @@ package engine
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/bitrainforest/PandaAgent/inside/checker"
+	"github.com/bitrainforest/PandaAgent/inside/client"
 	"github.com/bitrainforest/PandaAgent/inside/config"
 	"github.com/bitrainforest/PandaAgent/inside/deal"
 	"github.com/bitrainforest/PandaAgent/inside/downloader"
@@ -11,35 +14,93 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	DefaultShutdownTimeout = 5 * time.Minute
+)
+
 type Engine struct {
 	DealTransformer *deal.DealTransform
 	Transformer     *downloader.Transformer
-	Checker         checker.Checker
-	Buf             chan types.Sector
-	ctx             context.Context
-	cancle          context.CancelFunc
+	Checker         *checker.Checker
+	// Client is the connector to the platform, nil if not configured
+	Client *client.Client
+	Buf    chan types.Sector
+	// reload apply the configuration the platform pushed
+	reload  func() error
+	minerID string
+	ctx     context.Context
+	cancle  context.CancelFunc
 }
 
-func InitEngine(conf config.Config, ctx context.Context) Engine {
-	var engine Engine
-	engine.Transformer = downloader.InitTransformer(conf, ctx)
-	engine.Checker = checker.InitChecker(conf, ctx)
+func InitEngine(conf config.Config, ctx context.Context) (*Engine, error) {
+	var err error
+	engine := &Engine{}
+	if engine.Transformer, err = downloader.InitTransformer(conf, ctx); err != nil {
+		return nil, err
+	}
+	if engine.Checker, err = checker.InitChecker(conf, ctx); err != nil {
+		return nil, err
+	}
 	engine.Buf = make(chan types.Sector, 1024)
-	engine.DealTransformer = deal.InitDealTransform(conf, ctx)
+	if engine.DealTransformer, err = deal.InitDealTransform(conf, ctx); err != nil {
+		return nil, err
+	}
 	engine.ctx, engine.cancle = context.WithCancel(ctx)
-	return engine
+	engine.minerID = conf.Miner.ID
+	if conf.Connector.URL != "" {
+		cli, err := client.Init(conf, engine.handle)
+		if err != nil {
+			log.Error().Msgf("[Engine] init connector err: %s, poll only", err)
+		} else {
+			engine.Client = cli
+		}
+	}
+	return engine, nil
+}
+
+// SetReload set how the pushed configuration is applied
+func (eg *Engine) SetReload(reload func() error) {
+	eg.reload = reload
 }
 
-func (eg Engine) Run() error {
+func (eg *Engine) Run() error {
 	log.Info().Msgf("[Engine] Engine Start.")
+	eg.Checker.Register()
 	eg.Checker.Ping()
+	if eg.Client != nil {
+		// poll only when the connector is down
+		eg.Checker.SetPushed(eg.Client.Healthy)
+	}
 	eg.Checker.Check(eg.Buf)
 	eg.Transformer.Run(eg.Buf)
 	eg.DealTransformer.Run()
 	return nil
 }
 
-func (eg Engine) Stop() {
+// Reload apply the reloaded configuration to the running components
+func (eg *Engine) Reload(conf config.Config) {
+	log.Info().Msgf("[Engine] Engine Reload.")
+	eg.Checker.Reload(conf)
+	eg.Transformer.Reload(conf)
+	eg.DealTransformer.Reload(conf)
+}
+
+// Stop stop checking new sectors first, then drain the in-flight sectors and deals until ctx is done.
+func (eg *Engine) Stop(ctx context.Context) {
 	log.Info().Msgf("[Engine] Engine Stop.")
+	eg.Checker.Stop()
+	if eg.Client != nil {
+		eg.Client.Stop()
+	}
+	// the deals are flushed while the sectors drain, a slow drain never drops them
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		eg.DealTransformer.Stop(ctx)
+	}()
+	eg.Transformer.Stop(ctx)
+	wg.Wait()
 	eg.cancle()
+	log.Info().Msgf("[Engine] Engine Stopped.")
 }
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/bitrainforest/PandaAgent/inside/checker"
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/connector"
+	"github.com/rs/zerolog/log"
+)
+
+// handle process the message the platform pushed, and reply the result
+func (eg *Engine) handle(msg *connector.Message) {
+	var err error
+	switch msg.Type {
+	case connector.AssignType:
+		err = eg.assign(msg.Payload)
+	case connector.CancelType:
+		err = eg.cancel(msg.Payload)
+	case connector.ConfigType:
+		err = eg.configure(msg.Payload)
+	case connector.CommandType:
+		// the command replies itself once started
+		if err = eg.command(msg); err == nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported message type: %s", msg.Type)
+	}
+
+	if err != nil {
+		log.Error().Msgf("[Engine] handle %s message err: %s", msg.Type, err)
+		eg.Client.Response(msg.Session, connector.NewJsonMessage("", err.Error()))
+		return
+	}
+
+	eg.Client.Response(msg.Session, connector.NewJsonMessage("ok", ""))
+}
+
+// assign enqueue the pushed sectors, unlike the polling the sectors not pushed are kept
+func (eg *Engine) assign(payload []byte) error {
+	var data checker.Data
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return err
+	}
+
+	for _, s := range eg.Checker.Sectors(data.List) {
+		// avoid waste transform
+		if eg.Transformer.Skip(s) {
+			continue
+		}
+
+		log.Info().Msgf("[Engine] sector: %d pushed to download", s.ID)
+		select {
+		case eg.Buf <- s:
+		case <-eg.ctx.Done():
+			return eg.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (eg *Engine) cancel(payload []byte) error {
+	var p connector.CancelPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	for _, id := range p.SectorIDs {
+		sectorID, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("bad sector id %q", id)
+		}
+
+		if err := eg.Transformer.Withdraw(sectorID); err != nil {
+			log.Warn().Msgf("[Engine] withdraw sector: %d err: %s", sectorID, err)
+		}
+	}
+
+	return nil
+}
+
+// configure keep the pushed values and reload, the fields need restart are rejected like a reload
+func (eg *Engine) configure(payload []byte) error {
+	var p connector.ConfigPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+
+	if err := config.Push(p.Sets); err != nil {
+		return err
+	}
+
+	if eg.reload == nil {
+		return fmt.Errorf("reload is not supported")
+	}
+
+	return eg.reload()
+}
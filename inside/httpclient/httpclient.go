@@ -0,0 +1,181 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	DefaultKeepAlive = 30 * time.Second
+)
+
+// defaults are the settings every client used before they are configurable
+var defaults = map[string]config.HTTPEndpoint{
+	config.EndpointPlatform: {
+		Timeout:               10 * time.Second,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       10 * time.Second,
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   1,
+		MaxConnsPerHost:       10,
+	},
+	// the downloads share one client, the parallelism is limited by Transmission
+	config.EndpointDownload: {
+		Timeout:               10 * time.Minute,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       10 * time.Second,
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   10,
+	},
+	config.EndpointBoost: {
+		Timeout:               10 * time.Second,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       10 * time.Second,
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   1,
+		MaxConnsPerHost:       10,
+	},
+	config.EndpointMiner: {
+		Timeout:               10 * time.Second,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       10 * time.Second,
+		MaxIdleConns:          50,
+		MaxIdleConnsPerHost:   1,
+		MaxConnsPerHost:       10,
+	},
+}
+
+// Settings return the settings of the endpoint, the configured fields override the defaults
+func Settings(conf config.Config, endpoint string) config.HTTPEndpoint {
+	s := defaults[endpoint]
+	if endpoint == config.EndpointPlatform && conf.GH.Timeout > 0 {
+		s.Timeout = time.Duration(conf.GH.Timeout) * time.Second
+	}
+
+	e, ok := conf.HTTP.Endpoints[endpoint]
+	if !ok {
+		return s
+	}
+
+	if e.Timeout > 0 {
+		s.Timeout = e.Timeout
+	}
+	if e.DialTimeout > 0 {
+		s.DialTimeout = e.DialTimeout
+	}
+	if e.TLSHandshakeTimeout > 0 {
+		s.TLSHandshakeTimeout = e.TLSHandshakeTimeout
+	}
+	if e.ResponseHeaderTimeout > 0 {
+		s.ResponseHeaderTimeout = e.ResponseHeaderTimeout
+	}
+	if e.IdleConnTimeout > 0 {
+		s.IdleConnTimeout = e.IdleConnTimeout
+	}
+	if e.MaxIdleConns > 0 {
+		s.MaxIdleConns = e.MaxIdleConns
+	}
+	if e.MaxIdleConnsPerHost > 0 {
+		s.MaxIdleConnsPerHost = e.MaxIdleConnsPerHost
+	}
+	if e.MaxConnsPerHost > 0 {
+		s.MaxConnsPerHost = e.MaxConnsPerHost
+	}
+
+	return s
+}
+
+// New build the http client of the endpoint with the TLS and HTTP configuration.
+// The requests carry the common headers, and are counted in the expvar metrics. The ones to the
+// platform are signed with the identity key besides the miner token.
+func New(conf config.Config, endpoint string) (*http.Client, error) {
+	tlsConf, err := config.ClientTLS(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *identity.Key
+	if endpoint == config.EndpointPlatform {
+		key, err = identity.Load(conf.IdentityKey())
+		if errors.Is(err, identity.ErrNoKey) {
+			return nil, fmt.Errorf("%s, run `panda keys generate` first", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := Settings(conf, endpoint)
+	keepAlive := conf.HTTP.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy(conf),
+		DialContext: (&net.Dialer{
+			Timeout:   s.DialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		TLSClientConfig:       tlsConf,
+		ForceAttemptHTTP2:     !conf.HTTP.DisableHTTP2,
+		TLSHandshakeTimeout:   s.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: s.ResponseHeaderTimeout,
+		IdleConnTimeout:       s.IdleConnTimeout,
+		MaxIdleConns:          s.MaxIdleConns,
+		MaxIdleConnsPerHost:   s.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       s.MaxConnsPerHost,
+	}
+
+	return &http.Client{
+		Transport: &roundTripper{
+			endpoint: endpoint,
+			headers:  conf.HTTP.Headers,
+			agentID:  agentID(conf, endpoint),
+			key:      key,
+			next:     transport,
+		},
+		Timeout: s.Timeout,
+	}, nil
+}
+
+func agentID(conf config.Config, endpoint string) string {
+	if endpoint != config.EndpointPlatform {
+		return ""
+	}
+
+	return conf.AgentID
+}
+
+// proxy use HTTP.Proxy if configured, or the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env variables
+func proxy(conf config.Config) func(*http.Request) (*url.URL, error) {
+	if conf.HTTP.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	pc := &httpproxy.Config{
+		HTTPProxy:  conf.HTTP.Proxy,
+		HTTPSProxy: conf.HTTP.Proxy,
+		NoProxy:    conf.HTTP.NoProxy,
+	}
+	fn := pc.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}
+}
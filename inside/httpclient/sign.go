@@ -0,0 +1,65 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+)
+
+// the headers sign a request to the platform with the identity key, the key the connector handshake uses
+const (
+	HeaderKeyID     = "X-Agent-Key-Id"
+	HeaderTimestamp = "X-Agent-Timestamp"
+	HeaderNonce     = "X-Agent-Nonce"
+	HeaderSignature = "X-Agent-Signature"
+)
+
+// RequestText is signed by the agent key, the body is in its sha256
+func RequestText(method, uri string, timestamp int64, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{"PANDA AGENT REQUEST", method, uri, strconv.FormatInt(timestamp, 10),
+		nonce, hex.EncodeToString(sum[:])}, "\n"))
+}
+
+// sign add the signature headers to req, the body is read and set again
+func sign(key *identity.Key, req *http.Request) error {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+	}
+
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return err
+	}
+	timestamp, nonce := time.Now().Unix(), hex.EncodeToString(n)
+
+	sig, err := key.Sign(RequestText(req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HeaderKeyID, key.ID())
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
@@ -0,0 +1,77 @@
+package httpclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/identity"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	HeaderRequestID = "X-Request-Id"
+	// HeaderAgentID tells the platform which agent of the miner sends the request
+	HeaderAgentID = "X-Agent-Id"
+)
+
+// metrics are published at /debug/vars, like platform.requests, platform.status.200, platform.seconds
+var metrics = expvar.NewMap("http_client")
+
+// roundTripper add the common headers and a request id, and record the metrics
+type roundTripper struct {
+	endpoint string
+	headers  map[string]string
+	// agentID and the signature by key are only sent to the platform
+	agentID string
+	key     *identity.Key
+	next    http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the request should not be modified by RoundTrip
+	req = req.Clone(req.Context())
+	for k, v := range rt.headers {
+		if req.Header.Get(k) == "" {
+			req.Header.Set(k, v)
+		}
+	}
+	if req.Header.Get(HeaderRequestID) == "" {
+		req.Header.Set(HeaderRequestID, requestID())
+	}
+	if rt.agentID != "" {
+		req.Header.Set(HeaderAgentID, rt.agentID)
+	}
+	if rt.key != nil {
+		if err := sign(rt.key, req); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	metrics.Add(rt.endpoint+".requests", 1)
+	metrics.AddFloat(rt.endpoint+".seconds", elapsed.Seconds())
+	if err != nil {
+		metrics.Add(rt.endpoint+".errors", 1)
+		log.Trace().Msgf("[HTTPClient] %s %s %s id: %s err: %s, %s", rt.endpoint, req.Method, req.URL.Redacted(),
+			req.Header.Get(HeaderRequestID), err, elapsed)
+		return resp, err
+	}
+
+	metrics.Add(rt.endpoint+".status."+strconv.Itoa(resp.StatusCode), 1)
+	log.Trace().Msgf("[HTTPClient] %s %s %s id: %s status: %d, %s", rt.endpoint, req.Method, req.URL.Redacted(),
+		req.Header.Get(HeaderRequestID), resp.StatusCode, elapsed)
+	return resp, nil
+}
+
+func requestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
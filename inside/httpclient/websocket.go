@@ -0,0 +1,47 @@
+package httpclient
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/gorilla/websocket"
+)
+
+// Dialer build the websocket dialer of the connector, it shares the proxy, TLS and
+// the platform timeouts with the platform client.
+func Dialer(conf config.Config) (*websocket.Dialer, error) {
+	tlsConf, err := config.ClientTLS(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Settings(conf, config.EndpointPlatform)
+	keepAlive := conf.HTTP.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	return &websocket.Dialer{
+		Proxy: proxy(conf),
+		NetDialContext: (&net.Dialer{
+			Timeout:   s.DialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		TLSClientConfig:  tlsConf,
+		HandshakeTimeout: s.Timeout,
+	}, nil
+}
+
+// Headers return the common headers, they are added to the websocket handshake
+func Headers(conf config.Config) http.Header {
+	h := http.Header{}
+	for k, v := range conf.HTTP.Headers {
+		h.Set(k, v)
+	}
+	if conf.AgentID != "" {
+		h.Set(HeaderAgentID, conf.AgentID)
+	}
+
+	return h
+}
@@ -0,0 +1,276 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// the algorithms of the identity keys
+const (
+	Ed25519 = "ed25519"
+	RSA     = "rsa"
+
+	// DefaultRSABits is the size of a generated rsa key if not given
+	DefaultRSABits = 3072
+)
+
+var ErrNoKey = errors.New("no identity key")
+
+// Key is the keypair identifies the agent, Ed25519 signs as is and RSA signs with PSS over SHA-256
+type Key struct {
+	signer crypto.Signer
+}
+
+// Generate a key of alg, bits is only for rsa
+func Generate(alg string, bits int) (*Key, error) {
+	switch alg {
+	case Ed25519, "":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{signer: priv}, nil
+	case RSA:
+		if bits <= 0 {
+			bits = DefaultRSABits
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("rsa key of %d bits is too weak, 2048 at least", bits)
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{signer: priv}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q, should be %s or %s", alg, Ed25519, RSA)
+	}
+}
+
+// Load read a PKCS #8 private key, or a PKCS #1 rsa one, in pem format
+func Load(path string) (*Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", path, ErrNoKey)
+		}
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no pem data found", path)
+	}
+
+	var priv interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: parse private key err: %s", path, err)
+	}
+
+	switch k := priv.(type) {
+	case ed25519.PrivateKey:
+		return &Key{signer: k}, nil
+	case *rsa.PrivateKey:
+		return &Key{signer: k}, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported private key %T", path, priv)
+	}
+}
+
+// LoadOrCreate load the key of path, a new ed25519 one is created on first run
+func LoadOrCreate(path string) (*Key, error) {
+	k, err := Load(path)
+	if !errors.Is(err, ErrNoKey) {
+		return k, err
+	}
+
+	if k, err = Generate(Ed25519, 0); err != nil {
+		return nil, err
+	}
+
+	return k, k.Save(path)
+}
+
+// Save write the private key in PKCS #8 pem, only the owner can read it
+func (k *Key) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(k.signer)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// write aside and rename, a crash never leaves a broken key
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Algorithm return ed25519 or rsa
+func (k *Key) Algorithm() string {
+	return algorithm(k.signer.Public())
+}
+
+func (k *Key) Public() crypto.PublicKey {
+	return k.signer.Public()
+}
+
+// PublicPEM return the PKIX public key in pem format
+func (k *Key) PublicPEM() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(k.signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ID is the fingerprint of the public key
+func (k *Key) ID() string {
+	return Fingerprint(k.signer.Public())
+}
+
+// Sign msg, Ed25519 signs msg itself and RSA signs its SHA-256 with PSS
+func (k *Key) Sign(msg []byte) ([]byte, error) {
+	switch priv := k.signer.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(priv, msg), nil
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256(msg)
+		return rsa.SignPSS(rand.Reader, priv, crypto.SHA256, sum[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	default:
+		return nil, fmt.Errorf("unsupported private key %T", k.signer)
+	}
+}
+
+// Verify check sig is the signature of msg by pub, like Key.Sign
+func Verify(pub crypto.PublicKey, msg, sig []byte) error {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, msg, sig) {
+			return errors.New("bad ed25519 signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(msg)
+		return rsa.VerifyPSS(k, crypto.SHA256, sum[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	default:
+		return fmt.Errorf("unsupported public key %T", pub)
+	}
+}
+
+// LoadPublic read a PKIX public key in pem format
+func LoadPublic(path string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePublic(b)
+}
+
+// ParsePublic parse a PKIX public key in pem format
+func ParsePublic(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithm(pub) == "" {
+		return nil, fmt.Errorf("unsupported public key %T", pub)
+	}
+
+	return pub, nil
+}
+
+// Fingerprint is SHA256: and the base64 sha256 of the PKIX public key, like ssh-keygen -l
+func Fingerprint(pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func algorithm(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case ed25519.PublicKey:
+		return Ed25519
+	case *rsa.PublicKey:
+		return RSA
+	default:
+		return ""
+	}
+}
+
+// PreviousPath keeps the key before rotation until the platform accepts the new one
+func PreviousPath(path string) string {
+	return path + ".old"
+}
+
+// Rotate replace the key of path with a new one of alg, the old one is kept at PreviousPath
+// to vouch for the new one on next handshake.
+func Rotate(path, alg string, bits int) (*Key, error) {
+	if _, err := os.Stat(PreviousPath(path)); err == nil {
+		return nil, fmt.Errorf("the last rotation is not accepted by the platform yet, %s exists", PreviousPath(path))
+	}
+
+	if _, err := Load(path); err != nil {
+		return nil, err
+	}
+
+	k, err := Generate(alg, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path, PreviousPath(path)); err != nil {
+		return nil, err
+	}
+
+	if err := k.Save(path); err != nil {
+		// put the old one back
+		os.Rename(PreviousPath(path), path)
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Previous return the key before rotation, nil if no rotation is pending
+func Previous(path string) (*Key, error) {
+	k, err := Load(PreviousPath(path))
+	if errors.Is(err, ErrNoKey) {
+		return nil, nil
+	}
+
+	return k, err
+}
@@ -0,0 +1,182 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	Version = "2.0"
+	// lotus style apis authorize the request with a bearer token
+	AuthScheme = "Bearer "
+)
+
+// TokenFunc return the api token, it is called for every request so the token can rotate.
+type TokenFunc func() (string, error)
+
+// StaticToken return a TokenFunc which always return token
+func StaticToken(token string) TokenFunc {
+	return func() (string, error) {
+		return token, nil
+	}
+}
+
+// Request example
+/*
+'{
+	"jsonrpc": "2.0",
+	"method": "Filecoin.StorageDeclareSector",
+	"id": 1,
+	"params": [
+		"6b5bbb55-aaa2-4dec-8645-293b12c3d09c",
+		{
+			"Miner": 38310,
+			"Number": 21
+		},
+		2,
+		true
+	]
+}'
+*/
+type Request struct {
+	JsonRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      int64         `json:"id"`
+}
+
+type Response struct {
+	JsonRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      int64           `json:"id"`
+	// Raw is the response body as received, the fields not modeled here are kept
+	Raw json.RawMessage `json:"-"`
+}
+
+// Error is the json-rpc error object returned by the server
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Data) > 0 {
+		return fmt.Sprintf("json-rpc error %d: %s (%s)", e.Code, e.Message, string(e.Data))
+	}
+
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// Client is a json-rpc 2.0 client over http, it is safe for concurrent use.
+type Client struct {
+	cli   *http.Client
+	url   string
+	token TokenFunc
+	// the last request id, atomic
+	id int64
+}
+
+// NewClient create a client post to url, token may be nil if the server needs no authorization.
+func NewClient(cli *http.Client, url string, token TokenFunc) *Client {
+	return &Client{
+		cli:   cli,
+		url:   url,
+		token: token,
+	}
+}
+
+// Call invokes method with params and decodes the result into result, result may be nil.
+func (c *Client) Call(method string, result interface{}, params ...interface{}) error {
+	resp, err := c.Invoke(method, params...)
+	if err != nil {
+		return err
+	}
+
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("%s decode result err: %s", method, err)
+	}
+
+	return nil
+}
+
+// Invoke invokes method with params and return the whole response.
+// The error object in response is returned as *Error.
+func (c *Client) Invoke(method string, params ...interface{}) (*Response, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	r := Request{
+		JsonRPC: Version,
+		Method:  method,
+		Params:  params,
+		ID:      atomic.AddInt64(&c.id, 1),
+	}
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != nil {
+		token, err := c.token()
+		if err != nil {
+			return nil, fmt.Errorf("%s get token err: %s", method, err)
+		}
+
+		if token != "" {
+			if !strings.HasPrefix(token, AuthScheme) {
+				token = AuthScheme + token
+			}
+			req.Header.Set("Authorization", token)
+		}
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s err status: %d, body: %s", method, resp.StatusCode, string(b))
+	}
+
+	res := Response{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("%s bad response: %s", method, err)
+	}
+
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.ID != r.ID {
+		return nil, fmt.Errorf("%s response id: %d mismatch request id: %d", method, res.ID, r.ID)
+	}
+
+	res.Raw = b
+	return &res, nil
+}
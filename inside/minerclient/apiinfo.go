@@ -0,0 +1,180 @@
+package minerclient
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/jsonrpc"
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+)
+
+const (
+	EnvMinerAPIInfo = "MINER_API_INFO"
+	EnvMinerPath    = "LOTUS_MINER_PATH"
+	DefaultRepo     = "~/.lotusminer"
+	APIVersion      = "v0"
+)
+
+// same as lotus source code. (https://github.com/filecoin-project/lotus/blob/master/cli/util/apiinfo.go)
+var infoWithToken = regexp.MustCompile(`^[a-zA-Z0-9\-_]+?\.[a-zA-Z0-9\-_]+?\.([a-zA-Z0-9\-_]+)?:.+$`)
+
+// APIInfo is the lotus style api info, like token:/ip4/127.0.0.1/tcp/2345/http
+type APIInfo struct {
+	Addr  string
+	Token string
+}
+
+func ParseAPIInfo(s string) APIInfo {
+	s = strings.TrimSpace(s)
+	if !infoWithToken.MatchString(s) {
+		return APIInfo{Addr: s}
+	}
+
+	sp := strings.SplitN(s, ":", 2)
+	return APIInfo{
+		Addr:  sp[1],
+		Token: sp[0],
+	}
+}
+
+// URL return the json-rpc endpoint of the api, the addr may be a multiaddr or an url.
+func (a APIInfo) URL() (string, error) {
+	if !strings.HasPrefix(a.Addr, "/") {
+		return a.Addr, nil
+	}
+
+	return multiaddrToURL(a.Addr, APIVersion)
+}
+
+// multiaddrToURL converts multiaddr like /ip4/127.0.0.1/tcp/2345/http to http://127.0.0.1:2345/rpc/v0
+func multiaddrToURL(ma, version string) (string, error) {
+	parts := strings.Split(strings.Trim(ma, "/"), "/")
+	var host, port string
+	scheme := "http"
+	for i := 0; i < len(parts); i++ {
+		switch parts[i] {
+		case "ip4", "ip6", "dns", "dns4", "dns6":
+			if i+1 >= len(parts) {
+				return "", fmt.Errorf("multiaddr %s: missing %s value", ma, parts[i])
+			}
+			host = parts[i+1]
+			i++
+		case "tcp":
+			if i+1 >= len(parts) {
+				return "", fmt.Errorf("multiaddr %s: missing tcp port", ma)
+			}
+			port = parts[i+1]
+			i++
+		case "http", "ws":
+			scheme = "http"
+		case "https", "wss":
+			scheme = "https"
+		default:
+			return "", fmt.Errorf("multiaddr %s: unsupported protocol %s", ma, parts[i])
+		}
+	}
+
+	if host == "" || port == "" {
+		return "", fmt.Errorf("multiaddr %s: need host and tcp port", ma)
+	}
+
+	return fmt.Sprintf("%s://%s/rpc/%s", scheme, net.JoinHostPort(host, port), version), nil
+}
+
+// fileToken read the token from a file, and read it again once the file is modified
+type fileToken struct {
+	sync.Mutex
+	path  string
+	token string
+	mod   time.Time
+}
+
+func (ft *fileToken) Token() (string, error) {
+	ft.Lock()
+	defer ft.Unlock()
+
+	fi, err := os.Stat(ft.path)
+	if err != nil {
+		return "", err
+	}
+
+	if ft.token != "" && fi.ModTime().Equal(ft.mod) {
+		return ft.token, nil
+	}
+
+	b, err := os.ReadFile(ft.path)
+	if err != nil {
+		return "", err
+	}
+
+	ft.token = strings.TrimSpace(string(b))
+	ft.mod = fi.ModTime()
+	return ft.token, nil
+}
+
+func tokenFromFile(path string) jsonrpc.TokenFunc {
+	ft := &fileToken{path: util.ExpandHome(path)}
+	return ft.Token
+}
+
+// ResolveAPI return the url and token of the lotus-miner api, in order of:
+// Miner.Address with Miner.APIToken or Miner.APITokenFile, Miner.APIInfo, MINER_API_INFO
+// and at last the api and token files in Miner.Repo (LOTUS_MINER_PATH, ~/.lotusminer by default).
+func ResolveAPI(conf config.Config) (string, jsonrpc.TokenFunc, error) {
+	token := jsonrpc.StaticToken(conf.Miner.APIToken.Value())
+	if conf.Miner.APITokenFile != "" {
+		token = tokenFromFile(conf.Miner.APITokenFile)
+	}
+
+	if conf.Miner.Address != "" {
+		url, err := APIInfo{Addr: conf.Miner.Address}.URL()
+		return url, token, err
+	}
+
+	info := conf.Miner.APIInfo
+	if info == "" {
+		info = os.Getenv(EnvMinerAPIInfo)
+	}
+
+	if info != "" {
+		ai := ParseAPIInfo(info)
+		if ai.Token != "" {
+			token = jsonrpc.StaticToken(ai.Token)
+		}
+
+		url, err := ai.URL()
+		return url, token, err
+	}
+
+	repo := conf.Miner.Repo
+	if repo == "" {
+		repo = os.Getenv(EnvMinerPath)
+	}
+	if repo == "" {
+		repo = DefaultRepo
+	}
+	repo = util.ExpandHome(repo)
+
+	ma, err := os.ReadFile(filepath.Join(repo, "api"))
+	if err != nil {
+		return "", nil, fmt.Errorf("no miner api configured, and read api from repo %s err: %s", repo, err)
+	}
+
+	url, err := APIInfo{Addr: strings.TrimSpace(string(ma))}.URL()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if conf.Miner.APIToken == "" && conf.Miner.APITokenFile == "" {
+		token = tokenFromFile(filepath.Join(repo, "token"))
+	}
+
+	return url, token, nil
+}
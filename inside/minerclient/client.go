@@ -1,22 +1,16 @@
 package minerclient
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
-	"strings"
-	"time"
 
 	"github.com/bitrainforest/PandaAgent/inside/config"
+	"github.com/bitrainforest/PandaAgent/inside/httpclient"
+	"github.com/bitrainforest/PandaAgent/inside/jsonrpc"
 )
 
 const (
 	MethodFilecoinStorageDeclareSector = "Filecoin.StorageDeclareSector"
 	MethodFilecoinStorageFindSector    = "Filecoin.StorageFindSector"
-	DefaultID                          = 0
 	// 32GB size sector
 	SectorDefaultSize = 34359738368
 )
@@ -52,44 +46,20 @@ func (t SectorFileType) String() string {
 }
 
 type MinerCli struct {
-	cli       *http.Client
-	url       string
-	apiToken  string
+	rpc       *jsonrpc.Client
 	id        int
 	storageID string
 }
 
-// DeclareContent example
-/*
-'{
-	"method": "Filecoin.StorageDeclareSector",
-	"id": 0,
-	"params": [
-		"6b5bbb55-aaa2-4dec-8645-293b12c3d09c",
-		{
-			"Miner": 38310,
-			"Number": 21
-		},
-		2,
-		true
-	]
-}'
-*/
-type DeclareContent struct {
-	Method    string        `json:"method"`
-	DeclareID int           `json:"id"`
-	Params    []interface{} `json:"params"`
-}
-
-type FindSectorContent struct {
-	Method string        `json:"method"`
-	ID     int           `json:"id"`
-	Params []interface{} `json:"params"`
-}
-
-type FindSectorResult struct {
-	JsonRPC string        `json:"jsonrpc"`
-	Result  []interface{} `json:"result"`
+// SectorStorageInfo is one storage path lotus-miner reports for a sector file.
+type SectorStorageInfo struct {
+	ID       string   `json:"ID"`
+	URLs     []string `json:"URLs"`
+	BaseURLs []string `json:"BaseURLs"`
+	Weight   uint64   `json:"Weight"`
+	CanSeal  bool     `json:"CanSeal"`
+	CanStore bool     `json:"CanStore"`
+	Primary  bool     `json:"Primary"`
 }
 
 type MetaInfo struct {
@@ -97,113 +67,72 @@ type MetaInfo struct {
 	Number int `json:"Number"`
 }
 
-func InitMinerCli(conf config.Config) MinerCli {
-	id, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(conf.Miner.ID, "t"), "0"))
-	return MinerCli{
-		cli: &http.Client{
-			Transport: &http.Transport{
-				TLSHandshakeTimeout:   5 * time.Second,
-				ResponseHeaderTimeout: 10 * time.Second,
-				MaxIdleConns:          50,
-				MaxIdleConnsPerHost:   1,
-				MaxConnsPerHost:       10,
-				IdleConnTimeout:       10 * time.Second,
-			},
-			Timeout: 10 * time.Second,
-		},
-		apiToken:  conf.Miner.APIToken,
-		url:       conf.Miner.Address,
-		id:        id,
-		storageID: conf.Miner.StorageID,
-	}
-}
-
-func (mc MinerCli) SectorFind(sectorID int, sft SectorFileType) (bool, error) {
-	content := FindSectorContent{
-		Method: MethodFilecoinStorageFindSector,
-		ID:     DefaultID,
-	}
-
-	content.Params = append(content.Params, MetaInfo{
-		Miner:  mc.id,
-		Number: sectorID,
-	})
-	content.Params = append(content.Params, sft)
-	content.Params = append(content.Params, SectorDefaultSize)
-	content.Params = append(content.Params, true)
-
-	res, err := json.Marshal(content)
+func NewMinerCli(conf config.Config) (MinerCli, error) {
+	cli, err := httpclient.New(conf, config.EndpointMiner)
 	if err != nil {
-		return false, err
+		return MinerCli{}, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, mc.url, bytes.NewBuffer(res))
+	// the miner id may be t01000 or f01000
+	id, err := actorID(conf.Miner.ID)
 	if err != nil {
-		return false, err
+		return MinerCli{}, fmt.Errorf("Miner.ID: %s", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", mc.apiToken)
-
-	resp, err := mc.cli.Do(req)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
+	url, token, err := ResolveAPI(conf)
+	return MinerCli{
+		rpc:       jsonrpc.NewClient(cli, url, token),
+		id:        id,
+		storageID: conf.Miner.StorageID,
+	}, err
+}
 
-	if resp.StatusCode/100 != 2 {
-		return false, fmt.Errorf("SectorFind err status: %d", resp.StatusCode)
-	}
+// StorageID return the storage id sectors are declared in
+func (mc MinerCli) StorageID() string {
+	return mc.storageID
+}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, err
-	}
+// Filecoin.StorageDeclareSector
+func (mc MinerCli) StorageDeclareSector(storageID string, sector MetaInfo, sft SectorFileType, primary bool) error {
+	return mc.rpc.Call(MethodFilecoinStorageDeclareSector, nil, storageID, sector, sft, primary)
+}
 
-	findRes := FindSectorResult{}
-	if err := json.Unmarshal(b, &findRes); err != nil {
-		return false, err
+// Filecoin.StorageFindSector
+func (mc MinerCli) StorageFindSector(sector MetaInfo, sft SectorFileType, ssize int64, allowFetch bool) ([]SectorStorageInfo, error) {
+	var res []SectorStorageInfo
+	if err := mc.rpc.Call(MethodFilecoinStorageFindSector, &res, sector, sft, ssize, allowFetch); err != nil {
+		return nil, err
 	}
 
-	return len(findRes.Result) > 0, nil
+	return res, nil
 }
 
-func (mc MinerCli) SectorDeclare(sectorID int, sft SectorFileType) error {
-	content := DeclareContent{
-		Method:    MethodFilecoinStorageDeclareSector,
-		DeclareID: DefaultID,
-	}
-
-	content.Params = append(content.Params, mc.storageID)
-	content.Params = append(content.Params, MetaInfo{
+func (mc MinerCli) sector(sectorID int) MetaInfo {
+	return MetaInfo{
 		Miner:  mc.id,
 		Number: sectorID,
-	})
-	content.Params = append(content.Params, sft)
-	content.Params = append(content.Params, true)
-
-	res, err := json.Marshal(content)
-	if err != nil {
-		return err
 	}
+}
 
-	req, err := http.NewRequest(http.MethodPost, mc.url, bytes.NewBuffer(res))
+func (mc MinerCli) SectorFind(sectorID int, sft SectorFileType) (bool, error) {
+	res, err := mc.StorageFindSector(mc.sector(sectorID), sft, SectorDefaultSize, true)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", mc.apiToken)
+	return len(res) > 0, nil
+}
+
+// SectorLocate return the storage paths which already hold the sector file.
+// Unlike SectorFind it does not ask lotus for paths the file could be fetched to.
+func (mc MinerCli) SectorLocate(sectorID int, sft SectorFileType) ([]SectorStorageInfo, error) {
+	return mc.StorageFindSector(mc.sector(sectorID), sft, SectorDefaultSize, false)
+}
 
-	resp, err := mc.cli.Do(req)
-	if err != nil {
+func (mc MinerCli) SectorDeclare(sectorID int, sft SectorFileType) error {
+	if err := mc.StorageDeclareSector(mc.storageID, mc.sector(sectorID), sft, true); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("SectorDeclare err status: %d", resp.StatusCode)
-	}
 
 	exist, err := mc.SectorFind(sectorID, sft)
 	if err != nil {
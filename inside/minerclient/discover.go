@@ -0,0 +1,174 @@
+package minerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	MetaFile = "sectorstore.json"
+)
+
+// LocalStorageMeta is the content of sectorstore.json in a lotus storage path
+type LocalStorageMeta struct {
+	ID         string   `json:"ID"`
+	Weight     uint64   `json:"Weight"`
+	CanSeal    bool     `json:"CanSeal"`
+	CanStore   bool     `json:"CanStore"`
+	MaxStorage uint64   `json:"MaxStorage"`
+	Groups     []string `json:"Groups"`
+	AllowTo    []string `json:"AllowTo"`
+	AllowTypes []string `json:"AllowTypes"`
+	DenyTypes  []string `json:"DenyTypes"`
+}
+
+// StoragePath is a local storage path of the miner the agent can store sectors in
+type StoragePath struct {
+	ID   string
+	Path string
+	Meta LocalStorageMeta
+	Stat FsStat
+}
+
+func (sp StoragePath) SealedPath() string {
+	return filepath.Join(sp.Path, FTSealed.String())
+}
+
+func (sp StoragePath) CachePath() string {
+	return filepath.Join(sp.Path, FTCache.String())
+}
+
+// DiscoverStorage pick the storage path sectors should be stored in from the local paths of the miner.
+// The path must be able to store sealed and cache files, and match label (one of its Groups) and weight
+// when they are set. The highest weight wins, then the most available space.
+func (mc MinerCli) DiscoverStorage(label string, weight uint64) (StoragePath, error) {
+	local, err := mc.StorageLocal()
+	if err != nil {
+		return StoragePath{}, fmt.Errorf("get miner local storage err: %s", err)
+	}
+
+	if len(local) == 0 {
+		return StoragePath{}, fmt.Errorf("miner has no local storage path")
+	}
+
+	candidates := make([]StoragePath, 0, len(local))
+	rejects := make([]string, 0, len(local))
+	for id, path := range local {
+		meta, err := mc.storageMeta(id, path)
+		if err != nil {
+			rejects = append(rejects, fmt.Sprintf("%s (%s): %s", path, id, err))
+			continue
+		}
+
+		if reason := meta.reject(label, weight); reason != "" {
+			rejects = append(rejects, fmt.Sprintf("%s (%s): %s", path, id, reason))
+			continue
+		}
+
+		stat, err := mc.StorageStat(id)
+		if err != nil {
+			rejects = append(rejects, fmt.Sprintf("%s (%s): stat err: %s", path, id, err))
+			continue
+		}
+
+		candidates = append(candidates, StoragePath{
+			ID:   id,
+			Path: path,
+			Meta: meta,
+			Stat: stat,
+		})
+	}
+
+	if len(candidates) == 0 {
+		sort.Strings(rejects)
+		return StoragePath{}, fmt.Errorf("no storage path fits (label: %q, weight: %d):\n\t%s", label, weight, strings.Join(rejects, "\n\t"))
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Meta.Weight != candidates[j].Meta.Weight {
+			return candidates[i].Meta.Weight > candidates[j].Meta.Weight
+		}
+		return candidates[i].Stat.Available > candidates[j].Stat.Available
+	})
+
+	return candidates[0], nil
+}
+
+// storageMeta read sectorstore.json of the path, ask the miner if the path is not readable here.
+func (mc MinerCli) storageMeta(id, path string) (LocalStorageMeta, error) {
+	var meta LocalStorageMeta
+	b, err := os.ReadFile(filepath.Join(path, MetaFile))
+	if err == nil {
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return meta, fmt.Errorf("bad %s: %s", MetaFile, err)
+		}
+
+		if meta.ID != id {
+			return meta, fmt.Errorf("%s id: %s mismatch miner storage id", MetaFile, meta.ID)
+		}
+
+		return meta, nil
+	}
+
+	info, rerr := mc.StorageInfo(id)
+	if rerr != nil {
+		return meta, fmt.Errorf("read %s err: %s, storage info err: %s", MetaFile, err, rerr)
+	}
+
+	return LocalStorageMeta{
+		ID:         info.ID,
+		Weight:     info.Weight,
+		CanSeal:    info.CanSeal,
+		CanStore:   info.CanStore,
+		MaxStorage: info.MaxStorage,
+		Groups:     info.Groups,
+		AllowTo:    info.AllowTo,
+		AllowTypes: info.AllowTypes,
+		DenyTypes:  info.DenyTypes,
+	}, nil
+}
+
+// reject return why the path can not be used, empty if it can.
+func (m LocalStorageMeta) reject(label string, weight uint64) string {
+	if !m.CanStore {
+		return "can not store"
+	}
+
+	for _, ft := range []SectorFileType{FTSealed, FTCache} {
+		if !m.allowType(ft) {
+			return fmt.Sprintf("%s not allowed", ft)
+		}
+	}
+
+	if label != "" && !contains(m.Groups, label) {
+		return fmt.Sprintf("groups %v without label %q", m.Groups, label)
+	}
+
+	if weight != 0 && m.Weight != weight {
+		return fmt.Sprintf("weight %d mismatch", m.Weight)
+	}
+
+	return ""
+}
+
+func (m LocalStorageMeta) allowType(ft SectorFileType) bool {
+	if len(m.AllowTypes) > 0 && !contains(m.AllowTypes, ft.String()) {
+		return false
+	}
+
+	return !contains(m.DenyTypes, ft.String())
+}
+
+func contains(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,186 @@
+package minerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bitrainforest/PandaAgent/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrMismatch is the miner answered but it is not the configured one, retry never helps
+var ErrMismatch = errors.New("miner mismatch")
+
+// verifyRetryMax caps the wait between the verifications at 2^verifyRetryMax seconds
+const verifyRetryMax = 6
+
+const (
+	MethodFilecoinStorageList       = "Filecoin.StorageList"
+	MethodFilecoinStorageInfo       = "Filecoin.StorageInfo"
+	MethodFilecoinStorageLocal      = "Filecoin.StorageLocal"
+	MethodFilecoinStorageStat       = "Filecoin.StorageStat"
+	MethodFilecoinStorageDropSector = "Filecoin.StorageDropSector"
+	MethodFilecoinActorAddress      = "Filecoin.ActorAddress"
+	MethodFilecoinActorSectorSize   = "Filecoin.ActorSectorSize"
+)
+
+// Decl is one sector file declared in a storage path
+type Decl struct {
+	Miner          int            `json:"Miner"`
+	Number         int            `json:"Number"`
+	SectorFileType SectorFileType `json:"SectorFileType"`
+}
+
+// StorageInfo is the metadata of a storage path, mostly from its sectorstore.json
+type StorageInfo struct {
+	ID         string   `json:"ID"`
+	URLs       []string `json:"URLs"`
+	Weight     uint64   `json:"Weight"`
+	MaxStorage uint64   `json:"MaxStorage"`
+	CanSeal    bool     `json:"CanSeal"`
+	CanStore   bool     `json:"CanStore"`
+	Groups     []string `json:"Groups"`
+	AllowTo    []string `json:"AllowTo"`
+	AllowTypes []string `json:"AllowTypes"`
+	DenyTypes  []string `json:"DenyTypes"`
+}
+
+// FsStat is the disk usage of a storage path
+type FsStat struct {
+	Capacity    int64 `json:"Capacity"`
+	Available   int64 `json:"Available"`
+	FSAvailable int64 `json:"FSAvailable"`
+	Reserved    int64 `json:"Reserved"`
+	Max         int64 `json:"Max"`
+	Used        int64 `json:"Used"`
+}
+
+// Filecoin.StorageList, return the declared sector files of every storage id
+func (mc MinerCli) StorageList() (map[string][]Decl, error) {
+	res := make(map[string][]Decl)
+	if err := mc.rpc.Call(MethodFilecoinStorageList, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Filecoin.StorageInfo
+func (mc MinerCli) StorageInfo(storageID string) (StorageInfo, error) {
+	var res StorageInfo
+	err := mc.rpc.Call(MethodFilecoinStorageInfo, &res, storageID)
+	return res, err
+}
+
+// Filecoin.StorageLocal, return the local path of every storage id attached to the miner
+func (mc MinerCli) StorageLocal() (map[string]string, error) {
+	res := make(map[string]string)
+	if err := mc.rpc.Call(MethodFilecoinStorageLocal, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Filecoin.StorageStat
+func (mc MinerCli) StorageStat(storageID string) (FsStat, error) {
+	var res FsStat
+	err := mc.rpc.Call(MethodFilecoinStorageStat, &res, storageID)
+	return res, err
+}
+
+// Filecoin.StorageDropSector
+func (mc MinerCli) StorageDropSector(storageID string, sector MetaInfo, sft SectorFileType) error {
+	return mc.rpc.Call(MethodFilecoinStorageDropSector, nil, storageID, sector, sft)
+}
+
+// Filecoin.ActorAddress
+func (mc MinerCli) ActorAddress() (string, error) {
+	var res string
+	err := mc.rpc.Call(MethodFilecoinActorAddress, &res)
+	return res, err
+}
+
+// Filecoin.ActorSectorSize
+func (mc MinerCli) ActorSectorSize(addr string) (uint64, error) {
+	var res uint64
+	err := mc.rpc.Call(MethodFilecoinActorSectorSize, &res, addr)
+	return res, err
+}
+
+// SectorDrop drop the declaration of the sector file in storageID
+func (mc MinerCli) SectorDrop(storageID string, sectorID int, sft SectorFileType) error {
+	return mc.StorageDropSector(storageID, mc.sector(sectorID), sft)
+}
+
+// Verify check the miner we connect to is the configured one and it uses the sector size we support.
+func (mc MinerCli) Verify() error {
+	addr, err := mc.ActorAddress()
+	if err != nil {
+		return fmt.Errorf("get miner actor address err: %s", err)
+	}
+
+	id, err := actorID(addr)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMismatch, err)
+	}
+	if id != mc.id {
+		return fmt.Errorf("%w: actor address: %s, configured miner: %d", ErrMismatch, addr, mc.id)
+	}
+
+	size, err := mc.ActorSectorSize(addr)
+	if err != nil {
+		return fmt.Errorf("get miner sector size err: %s", err)
+	}
+
+	if size != SectorDefaultSize {
+		return fmt.Errorf("%w: sector size: %d not supported, only %d now", ErrMismatch, size, uint64(SectorDefaultSize))
+	}
+
+	return nil
+}
+
+// WaitVerify is Verify, but it waits for the miner while it is not reachable, like restarting.
+// It only return ErrMismatch, or the error of ctx once it is done.
+func (mc MinerCli) WaitVerify(ctx context.Context) error {
+	var retry int64
+	for {
+		err := mc.Verify()
+		if err == nil || errors.Is(err, ErrMismatch) {
+			return err
+		}
+
+		wait := time.Duration(util.Pow2(retry)) * time.Second
+		if retry < verifyRetryMax {
+			retry++
+		}
+		log.Warn().Msgf("[MinerCli] verify the miner err: %s, retry in %s", err, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// actorID parse the id from a miner address like t01000 or f01000
+func actorID(addr string) (int, error) {
+	if len(addr) < 3 || (addr[0] != 't' && addr[0] != 'f') || addr[1] != '0' {
+		return 0, fmt.Errorf("%q is not an id address", addr)
+	}
+
+	id, err := strconv.Atoi(addr[2:])
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an id address", addr)
+	}
+
+	return id, nil
+}
+
+// SectorDeclareIn declare the sector file in storageID, it is the primary copy
+func (mc MinerCli) SectorDeclareIn(storageID string, sectorID int, sft SectorFileType) error {
+	return mc.StorageDeclareSector(storageID, mc.sector(sectorID), sft, true)
+}
@@ -1 +1,100 @@
 package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Admin is the http api for operators, it should only listen on a trusted address
+type Admin struct {
+	srv *http.Server
+	mux *http.ServeMux
+	// token is required in the Authorization header if not empty
+	token string
+}
+
+type Response struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// InitAdmin create the admin api, reload is called by POST /admin/reload.
+// The requests must carry token as Authorization: Bearer <token> if it is not empty.
+func InitAdmin(addr, token string, reload func() error) *Admin {
+	a := &Admin{
+		mux:   http.NewServeMux(),
+		token: token,
+	}
+	a.srv = &http.Server{
+		Addr:              addr,
+		Handler:           a.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	a.Handle("/admin/reload", http.MethodPost, func(r *http.Request) (interface{}, error) {
+		return nil, reload()
+	})
+
+	return a
+}
+
+// Handle register fn for the pattern and method, the result of fn is written as json
+func (a *Admin) Handle(pattern, method string, fn func(r *http.Request) (interface{}, error)) {
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			writeJSON(w, http.StatusUnauthorized, Response{Code: http.StatusUnauthorized, Msg: "unauthorized"})
+			return
+		}
+
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, Response{Code: http.StatusMethodNotAllowed, Msg: "method not allowed"})
+			return
+		}
+
+		data, err := fn(r)
+		if err != nil {
+			log.Error().Msgf("[Admin] %s %s err: %s", r.Method, r.URL.Path, err)
+			writeJSON(w, http.StatusInternalServerError, Response{Code: http.StatusInternalServerError, Msg: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, Response{Code: http.StatusOK, Msg: "success", Data: data})
+	})
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (a *Admin) Run() {
+	log.Info().Msgf("[Admin] listen on %s", a.srv.Addr)
+	go func() {
+		if err := a.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Msgf("[Admin] listen err: %s", err)
+		}
+	}()
+}
+
+func (a *Admin) Stop(ctx context.Context) {
+	if err := a.srv.Shutdown(ctx); err != nil {
+		log.Error().Msgf("[Admin] shutdown err: %s", err)
+	}
+}
@@ -37,6 +37,24 @@ type Sector struct {
 			1000: means just do callback
 	*/
 	Status SectorDownloadStatus
+	// Located marks the files (NeedDownloadSealed, NeedDownloadCache) the miner
+	// already holds, they are never downloaded or declared again.
+	Located SectorDownloadStatus
+	// Relocated marks the files copied from a seal storage into the store path, they are declared but not downloaded.
+	Relocated SectorDownloadStatus `json:",omitempty"`
+	// Source is the one in Transmission.Sources to download from, the default one if empty
+	Source string `json:",omitempty"`
+	// Miner owns the sector, the queue is fair across miners
+	Miner string `json:",omitempty"`
+	// Priority is taken higher first, the platform marks the urgent ones
+	Priority int `json:",omitempty"`
+	// Manual sectors are requested by a command, they are not withdrawn if the platform list misses them
+	Manual bool `json:",omitempty"`
+}
+
+// Rewind reset the sector to status for a retry, the located and relocated files are kept skipped.
+func (s *Sector) Rewind(status SectorDownloadStatus) {
+	s.Status = status &^ (s.Located | s.Relocated)
 }
 
 func (s Sector) NeedDownloadSealed() bool {
@@ -4,4 +4,6 @@ import "time"
 
 var (
 	TimeFormat = time.RFC3339
+	// Version of the agent, it is set by main
+	Version = "No version"
 )
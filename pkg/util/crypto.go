@@ -7,11 +7,25 @@ import (
 	"encoding/pem"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
-func RSAGenKey(bits int) error {
+// RSAGenKey write a rsa keypair of bits to encrypt the secrets into dir, private.pem in PKCS #1
+// only the owner can read and public.pem in PKIX. The existing keys are never overwritten.
+func RSAGenKey(bits int, dir string) error {
+	if bits < 2048 {
+		return fmt.Errorf("rsa key of %d bits is too weak, 2048 at least", bits)
+	}
+
+	privatePath, publicPath := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	for _, p := range []string{privatePath, publicPath} {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s exists", p)
+		}
+	}
+
 	// private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return err
 	}
@@ -20,76 +34,141 @@ func RSAGenKey(bits int) error {
 		Type:  "RSA PRIVATE KEY",
 		Bytes: privateStream,
 	}
-	fPrivate, err := os.Create("private.pem")
-	if err != nil {
-		return err
-	}
-	defer fPrivate.Close()
-	err = pem.Encode(fPrivate, &block1)
-	if err != nil {
-		return err
-	}
 
 	// public key
-	publicKey := privateKey.PublicKey
 	// 使用x509.MarshalPKCS1PublicKey无法解析
-	publicStream, err := x509.MarshalPKIXPublicKey(&publicKey)
+	publicStream, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
 	if err != nil {
 		return err
 	}
 	block2 := pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: publicStream,
 	}
-	fPublic, err := os.Create("public.pem")
-	if err != nil {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&block1), 0600); err != nil {
 		return err
 	}
-	defer fPublic.Close()
-	pem.Encode(fPublic, &block2)
-	return nil
+
+	return os.WriteFile(publicPath, pem.EncodeToMemory(&block2), 0644)
 }
 
 func EncryptRSA(src []byte, keyPath string) ([]byte, error) {
-	f, err := os.Open(keyPath)
+	pubKey, err := LoadRSAPublicKey(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	fileInfo, err := f.Stat()
+	res, err := rsa.EncryptPKCS1v15(rand.Reader, pubKey, src)
+	return res, err
+}
+
+func DecryptRSA(src []byte, path string) ([]byte, error) {
+	privateKey, err := LoadRSAPrivateKey(path)
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, fileInfo.Size())
-	f.Read(b)
-	block, _ := pem.Decode(b)
+	res, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, src)
+	return res, err
+}
 
-	keyInit, err := x509.ParsePKIXPublicKey(block.Bytes)
+// EncryptRSALong encrypt src longer than one block by splitting it into blocks
+func EncryptRSALong(src []byte, keyPath string) ([]byte, error) {
+	pubKey, err := LoadRSAPublicKey(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	pubKey := keyInit.(*rsa.PublicKey)
-	res, err := rsa.EncryptPKCS1v15(rand.Reader, pubKey, src)
-	return res, err
+
+	// PKCS #1 v1.5 needs 11 bytes padding
+	chunk := pubKey.Size() - 11
+	res := make([]byte, 0, (len(src)/chunk+1)*pubKey.Size())
+	for start := 0; start < len(src); start += chunk {
+		end := start + chunk
+		if end > len(src) {
+			end = len(src)
+		}
+
+		b, err := rsa.EncryptPKCS1v15(rand.Reader, pubKey, src[start:end])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b...)
+	}
+
+	return res, nil
 }
 
-func DecryptRSA(src []byte, path string) ([]byte, error) {
-	f, err := os.Open(path)
+// DecryptRSALong decrypt the src encrypted by EncryptRSALong
+func DecryptRSALong(src []byte, path string) ([]byte, error) {
+	privateKey, err := LoadRSAPrivateKey(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	fileInfo, err := f.Stat()
+
+	size := privateKey.Size()
+	if len(src)%size != 0 {
+		return nil, fmt.Errorf("ciphertext length %d is not multiple of key size %d", len(src), size)
+	}
+
+	res := make([]byte, 0, len(src))
+	for start := 0; start < len(src); start += size {
+		b, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, src[start:start+size])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b...)
+	}
+
+	return res, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no pem data found", path)
+	}
+
+	return block, nil
+}
+
+// LoadRSAPublicKey read a PKIX rsa public key in pem format
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInit, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, ok := keyInit.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a rsa public key", path)
+	}
+
+	return pubKey, nil
+}
+
+// LoadRSAPrivateKey read a PKCS #1 rsa private key in pem format
+func LoadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, fileInfo.Size())
-	f.Read(b)
-	block, _ := pem.Decode(b)                                 //解码
+
 	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes) //还原数据
 	if err != nil {
 		return nil, fmt.Errorf("parse private key error: %s", err)
 	}
-	res, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, src)
-	return res, err
+
+	return privateKey, nil
 }
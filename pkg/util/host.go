@@ -0,0 +1,33 @@
+package util
+
+import (
+	"net"
+	"os"
+)
+
+// Host is the identity of the machine the agent runs on
+type Host struct {
+	Hostname string   `json:"hostname,omitempty"`
+	IPs      []string `json:"ips,omitempty"`
+}
+
+// HostInfo return the hostname and the non loopback addresses of the machine
+func HostInfo() Host {
+	h := Host{}
+	h.Hostname, _ = os.Hostname()
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return h
+	}
+
+	for _, addr := range addrs {
+		ipn, ok := addr.(*net.IPNet)
+		if !ok || ipn.IP.IsLoopback() || ipn.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		h.IPs = append(h.IPs, ipn.IP.String())
+	}
+
+	return h
+}
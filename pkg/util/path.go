@@ -0,0 +1,21 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExpandHome replace the leading ~ of path with the home directory
+func ExpandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}